@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/csv"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"sync"
 	"sync/atomic"
+
+	"github.com/ipfs/go-cid"
 )
 
 var carDriverCreator = driverCreator{
@@ -13,91 +19,361 @@ var carDriverCreator = driverCreator{
 	maxCarSize: 1 << 42,
 }
 
+// defaultCarPathFormat is used when the car driver is given no path.
+const defaultCarPathFormat = "out.%d.car"
+
 func carHelp(out io.Writer) {
 	fmt.Fprint(out, `  Positional:
-  - <PATH_FORMAT> defaults to "out.%d.car"
+  - <PATH_FORMAT> defaults to "`, defaultCarPathFormat, `"
+  Options:
+  - version=<1|2> CARv2 adds a trailing index for random access, defaults to 1
+  - manifest=<json|cbor> writes <PATH>.manifest.<json|cbor> listing the blocks,
+    files and padding of each car, defaults to none
+  - commp=<bool> computes the Filecoin piece CID and padded piece size of each
+    car (added to the manifest), the blocks are read back from the temp car
+    to hash them in car order, defaults to false
+  - deals=<CSV_PATH> appends path,root,piece cid,piece size,car size of each
+    car to CSV_PATH for offline deals, implies commp
+  - order=<reverse|dfs> reverse copies the blocks in the reverse of the order
+    they were chunked in, dfs writes them depth first from the root with each
+    block before its children so the car can be verified while streamed,
+    defaults to reverse
+  - align=<bool> with order=dfs, pads before leaves so their data is aligned
+    and reflinked, streaming verifiers rejecting blocks not linked by the
+    root need false, defaults to true
 
 `)
 }
 
 func newCarDriver(input string) (driver, error) {
-	if input == "" {
-		input = "out.%d.car"
+	pathFormat, opts, err := parseDriverParams(input)
+	if err != nil {
+		return nil, err
+	}
+	if pathFormat == "" {
+		pathFormat = defaultCarPathFormat
 	}
-
 	d := &carDriver{
-		pathFormat: input,
+		pathFormat: pathFormat,
+	}
+	switch version := opts.take("version", "1"); version {
+	case "1":
+	case "2":
+		d.v2 = true
+	default:
+		return nil, fmt.Errorf("unsupported car version %q", version)
+	}
+	switch d.manifest = opts.take("manifest", ""); d.manifest {
+	case "", "json", "cbor":
+	default:
+		return nil, fmt.Errorf("unsupported manifest format %q", d.manifest)
+	}
+	switch order := opts.take("order", "reverse"); order {
+	case "reverse":
+	case "dfs":
+		d.dfs = true
+	default:
+		return nil, fmt.Errorf("unsupported order %q", order)
+	}
+	d.align, err = opts.takeBool("align", true)
+	if err != nil {
+		return nil, err
+	}
+	d.commp, err = opts.takeBool("commp", false)
+	if err != nil {
+		return nil, err
+	}
+	deals := opts.take("deals", "")
+	if deals != "" {
+		d.commp = true
+	}
+	err = opts.done()
+	if err != nil {
+		return nil, err
+	}
+	if deals != "" && !validateOnly {
+		d.deals, err = openDeals(deals)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return d.send, nil
+	return d, nil
+}
+
+// openDeals opens the deals CSV for appending, the header is written if it
+// is new.
+func openDeals(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening deals csv: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stating deals csv: %w", err)
+	}
+	if st.Size() == 0 {
+		err = writeDealsRecord(f, "path", "root", "piece_cid", "piece_size", "car_size")
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("writing deals csv header: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// writeDealsRecord appends a line to the deals csv.
+func writeDealsRecord(f *os.File, fields ...string) error {
+	w := csv.NewWriter(f)
+	err := w.Write(fields)
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
 }
 
 type carDriver struct {
 	pathFormat string
 	counter    uint32
+	// v2 writes a CARv2 wrapping the CARv1 and its index.
+	v2 bool
+	// manifest is the format of the sidecar manifest, empty for none.
+	manifest string
+	// dfs writes the blocks depth first from the root, align pads leaves so
+	// they stay reflinked.
+	dfs   bool
+	align bool
+	// commp computes the piece CID of the written cars.
+	commp bool
+	// deals is the csv the pieces are appended to, nil for none.
+	deals     *os.File
+	dealsLock sync.Mutex
 }
 
-func (c *carDriver) send(headerBuffer []byte, car *os.File, carOffset int64) error {
+func (c *carDriver) Send(_ context.Context, payload CarPayload) (Receipt, error) {
+	headerBuffer, car, carOffset := payload.Header, payload.Car, payload.CarOffset
 	n := atomic.AddUint32(&c.counter, 1)
 	outName := fmt.Sprintf(c.pathFormat, n)
-	outF, err := os.OpenFile(outName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	outF, err := os.OpenFile(outName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
 	if err != nil {
 		outF.Close()
 		os.Remove(outName)
-		return fmt.Errorf("creating failed out file %q: %w", outName, err)
+		return Receipt{}, fmt.Errorf("creating failed out file %q: %w", outName, err)
+	}
+	// The commp is fed what is written in output order, so the CARv2 header
+	// which is written last must be computed up front. The copied blocks are
+	// read back from the temp car, the chunker writes it back to front before
+	// the header is known so it can't hash them in car order.
+	var cw *commpWriter
+	if c.commp {
+		cw = &commpWriter{}
+	}
+	var base int64
+	if c.v2 {
+		// The CARv2 header is written once the rest is.
+		base = carV2DataOffset
+		_, err = outF.Write(make([]byte, base))
+		if err != nil {
+			outF.Close()
+			os.Remove(outName)
+			return Receipt{}, fmt.Errorf("reserving CARv2 header in %q: %w", outName, err)
+		}
+	}
+	if c.dfs {
+		d, err := planDFSCar(base, payload, c.align)
+		if err == nil {
+			if c.v2 {
+				cw.feed(makeCarV2Header(uint64(d.end-base), uint64(d.end)))
+			}
+			err = d.write(outF, cw)
+		}
+		if err == nil && c.v2 {
+			err = writeCarV2Trailer(outF, cw, d.records, d.headerLen, 0, d.end-base)
+		}
+		if err != nil {
+			outF.Close()
+			os.Remove(outName)
+			return Receipt{}, fmt.Errorf("writing %q depth first: %w", outName, err)
+		}
+		return c.finish(outF, outName, payload, cw, func(version uint64, size int64) carManifest {
+			p := payload
+			p.Header = payload.Header[:d.headerLen]
+			p.Index = d.records
+			m := makeCarManifest(p, version, size, base, 0)
+			if d.headerPad != 0 {
+				m.Padding = append([]carManifestPadding{{Offset: base + d.headerLen, Length: d.headerPad}}, m.Padding...)
+			}
+			return m
+		})
 	}
 	headerLen := int64(len(headerBuffer))
+	// Copy with explicit offsets since other drivers may read the car at the same time.
+	woff, roff, remaining := base+headerLen, carOffset, payload.Size-headerLen
+	// shift is how much the temp car moved compared to the payload.
+	var shift int64
+	var padCar, padHeader uint16
+	if !noPad {
+		padCar = diskAssumedBlockSize - uint16(carOffset)%diskAssumedBlockSize
+		padHeader = (diskAssumedBlockSize - padCar - uint16(headerLen)) % diskAssumedBlockSize
+		if padHeader != 0 && padHeader < fakeBlockMinLength {
+			// we can't pad so little, pad to the next size
+			padHeader += diskAssumedBlockSize
+		}
+		shift = int64(padHeader)
+	}
+	if c.v2 {
+		dataSize := payload.Size + shift
+		cw.feed(makeCarV2Header(uint64(dataSize), uint64(carV2DataOffset+dataSize)))
+	}
+
 	_, err = outF.Write(headerBuffer)
 	if err != nil {
 		outF.Close()
 		os.Remove(outName)
-		return fmt.Errorf("writing header to failed out file %q: %w", outName, err)
+		return Receipt{}, fmt.Errorf("writing header to failed out file %q: %w", outName, err)
+	}
+	cw.feed(headerBuffer)
+
+	if padHeader != 0 {
+		pad := createPadBlockHeader(padHeader)
+		_, err = outF.Write(pad)
+		if err != nil {
+			outF.Close()
+			os.Remove(outName)
+			return Receipt{}, fmt.Errorf("writing pad block to %q: %w", outName, err)
+		}
+		cw.feed(pad)
+		cw.feedZeros(int64(padHeader) - int64(len(pad)))
+		woff += int64(padHeader)
+	}
+
+	if padCar != 0 {
+		// Copy only so little bytes to continue copying later alligned to the diskAssumedBlockSize
+		l := int64(padCar)
+		if l > remaining {
+			l = remaining
+		}
+		err = copyFileRange(outF, woff, car, roff, l)
+		if err == nil {
+			err = cw.feedRange(car, roff, l)
+		}
+		if err != nil {
+			outF.Close()
+			os.Remove(outName)
+			return Receipt{}, fmt.Errorf("precopying the pad car to %q: %w", outName, err)
+		}
+		woff += l
+		roff += l
+		remaining -= l
+	}
+
+	err = copyFileRange(outF, woff, car, roff, remaining)
+	if err == nil {
+		err = cw.feedRange(car, roff, remaining)
+	}
+	if err == nil && c.v2 {
+		err = writeCarV2Trailer(outF, cw, payload.Index, headerLen, shift, woff+remaining-base)
 	}
-	_, err = car.Seek(carOffset, io.SeekStart)
 	if err != nil {
 		outF.Close()
 		os.Remove(outName)
-		return fmt.Errorf("seeking car to failed out file %q: %w", outName, err)
+		return Receipt{}, fmt.Errorf("copying buffer to %q: %w", outName, err)
 	}
+	return c.finish(outF, outName, payload, cw, func(version uint64, size int64) carManifest {
+		return makeCarManifest(payload, version, size, base, shift)
+	})
+}
 
-	if !noPad {
-		padCar := diskAssumedBlockSize - uint16(carOffset)%diskAssumedBlockSize
-		padHeader := (diskAssumedBlockSize - padCar - uint16(headerLen)) % diskAssumedBlockSize
-
-		if padHeader != 0 {
-			if padHeader < fakeBlockMinLength {
-				// we can't pad so little, pad to the next size
-				padHeader += diskAssumedBlockSize
-			}
-
-			_, err = outF.Write(createPadBlockHeader(padHeader))
-			if err != nil {
-				return fmt.Errorf("writing pad block to %q: %w", outName, err)
-			}
+// finish adds the commp, manifest and deals entry of the car written to
+// outF, it closes outF and removes it on errors. cw is fed the whole car,
+// nil if the commp isn't computed.
+func (c *carDriver) finish(outF *os.File, outName string, payload CarPayload, cw *commpWriter, manifest func(version uint64, size int64) carManifest) (Receipt, error) {
+	st, err := outF.Stat()
+	if err != nil {
+		outF.Close()
+		os.Remove(outName)
+		return Receipt{}, fmt.Errorf("stating %q: %w", outName, err)
+	}
+	size := st.Size()
 
-			_, err = outF.Seek(headerLen+int64(padHeader), io.SeekStart)
-			if err != nil {
-				return fmt.Errorf("seeking after pad block to %q: %w", outName, err)
-			}
+	receipt := Receipt{Info: map[string]string{"path": outName}}
+	var pieceCid cid.Cid
+	var pieceSize uint64
+	if cw != nil {
+		if cw.size != size {
+			err = fmt.Errorf("hashed %d bytes but wrote %d", cw.size, size)
+		} else {
+			pieceCid, pieceSize, err = cw.sum()
+		}
+		if err != nil {
+			outF.Close()
+			os.Remove(outName)
+			return Receipt{}, fmt.Errorf("computing commp of %q: %w", outName, err)
 		}
+		receipt.Info["pieceCid"] = pieceCid.String()
+		receipt.Info["pieceSize"] = strconv.FormatUint(pieceSize, 10)
+	}
+	outF.Close()
 
-		if padCar != 0 {
-			// Read only so little bytes to continue reading later alligned to the diskAssumedBlockSize
-			_, err = outF.ReadFrom(&io.LimitedReader{
-				R: car,
-				N: int64(padCar),
-			})
-			if err != nil {
-				return fmt.Errorf("precopying the pad car to %q: %w", outName, err)
-			}
+	if c.manifest != "" {
+		version := uint64(1)
+		if c.v2 {
+			version = 2
+		}
+		m := manifest(version, size)
+		if cw != nil {
+			m.PieceCid, m.PieceSize = &pieceCid, pieceSize
+		}
+		manifestName, err := writeCarManifest(outName, c.manifest, m)
+		if err != nil {
+			os.Remove(outName)
+			return Receipt{}, err
+		}
+		receipt.Info["manifest"] = manifestName
+	}
+	if c.deals != nil {
+		c.dealsLock.Lock()
+		err = writeDealsRecord(c.deals, outName, payload.Root.String(), pieceCid.String(), strconv.FormatUint(pieceSize, 10), strconv.FormatInt(size, 10))
+		c.dealsLock.Unlock()
+		if err != nil {
+			return Receipt{}, fmt.Errorf("writing deals csv: %w", err)
 		}
 	}
+	return receipt, nil
+}
 
-	_, err = outF.ReadFrom(car)
-	outF.Close()
+// writeCarV2Trailer writes the index after the CARv1 of dataSize bytes and
+// the CARv2 header, index offsets past headerLen are moved by shift. Only the
+// index is fed to cw, the CARv2 header comes first and is fed before the data.
+func writeCarV2Trailer(outF *os.File, cw *commpWriter, index []carIndexRecord, headerLen, shift, dataSize int64) error {
+	records := make([]carIndexRecord, len(index))
+	for i, r := range index {
+		if r.Offset >= headerLen {
+			r.Offset += shift
+		}
+		records[i] = r
+	}
+	idx, err := marshalMultihashIndexSorted(records)
 	if err != nil {
-		os.Remove(outName)
-		return fmt.Errorf("copying buffer to %q: %w", outName, err)
+		return fmt.Errorf("making index: %w", err)
+	}
+	indexOffset := carV2DataOffset + dataSize
+	_, err = outF.WriteAt(idx, indexOffset)
+	if err != nil {
+		return fmt.Errorf("writing index: %w", err)
 	}
+	cw.feed(idx)
+	_, err = outF.WriteAt(makeCarV2Header(uint64(dataSize), uint64(indexOffset)), 0)
+	if err != nil {
+		return fmt.Errorf("writing CARv2 header: %w", err)
+	}
+	return nil
+}
 
+func (c *carDriver) Close() error {
+	if c.deals != nil {
+		return c.deals.Close()
+	}
 	return nil
 }
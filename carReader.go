@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	// maxCarHeaderSize protects against allocating garbage sizes.
+	maxCarHeaderSize = 32 << 20
+	// maxCidLength is more than any CID this reads should use.
+	maxCidLength = 128
+)
+
+// carBlock is a block in a CAR, Offset and Length locate its data and Start
+// its section (the length varint).
+type carBlock struct {
+	Cid    cid.Cid
+	Start  int64
+	Offset int64
+	Length int64
+}
+
+// carLayout locates the CARv1 data and the index of a CAR file.
+type carLayout struct {
+	Version    uint64
+	DataOffset int64
+	DataSize   int64
+	// IndexOffset is 0 if there is no index.
+	IndexOffset int64
+}
+
+// readCarLayout reads the CARv2 header of the CAR of size bytes in r, CARv1
+// are returned as their whole data.
+func readCarLayout(r io.ReaderAt, size int64) (carLayout, error) {
+	var b [carV2PragmaSize + carV2HeaderSize]byte
+	n, err := r.ReadAt(b[:], 0)
+	if n < carV2PragmaSize || !bytes.Equal(b[:carV2PragmaSize], carV2Pragma[:]) {
+		return carLayout{Version: 1, DataSize: size}, nil
+	}
+	if n != len(b) {
+		return carLayout{}, fmt.Errorf("reading CARv2 header: %w", err)
+	}
+	h := b[carV2PragmaSize:]
+	l := carLayout{
+		Version:     2,
+		DataOffset:  int64(binary.LittleEndian.Uint64(h[16:])),
+		DataSize:    int64(binary.LittleEndian.Uint64(h[24:])),
+		IndexOffset: int64(binary.LittleEndian.Uint64(h[32:])),
+	}
+	if l.DataOffset < int64(len(b)) || l.DataSize < 0 || l.DataOffset > size || l.DataSize > size-l.DataOffset {
+		return carLayout{}, fmt.Errorf("CARv2 data at %d of %d bytes is outside the %d bytes file", l.DataOffset, l.DataSize, size)
+	}
+	if l.IndexOffset != 0 && (l.IndexOffset < l.DataOffset+l.DataSize || l.IndexOffset >= size) {
+		return carLayout{}, fmt.Errorf("CARv2 index at %d is outside the %d bytes file or in the data", l.IndexOffset, size)
+	}
+	return l, nil
+}
+
+// readCarHeader reads a CARv1 header, it returns the offset of the first
+// block.
+func readCarHeader(r io.ReaderAt) (carHeader, int64, error) {
+	l, n, err := readUvarintAt(r, 0)
+	if err != nil {
+		return carHeader{}, 0, fmt.Errorf("reading header length: %w", err)
+	}
+	if l == 0 || l > maxCarHeaderSize {
+		return carHeader{}, 0, fmt.Errorf("invalid header length %d", l)
+	}
+	buf := make([]byte, l)
+	_, err = r.ReadAt(buf, int64(n))
+	if err != nil {
+		return carHeader{}, 0, fmt.Errorf("reading header: %w", err)
+	}
+	var h carHeader
+	err = cbor.DecodeInto(buf, &h)
+	if err != nil {
+		return carHeader{}, 0, fmt.Errorf("decoding header: %w", err)
+	}
+	if h.Version != 1 {
+		return carHeader{}, 0, fmt.Errorf("unsupported car version %d", h.Version)
+	}
+	return h, int64(n) + int64(l), nil
+}
+
+// readCarBlocks calls f with each block between off and end.
+func readCarBlocks(r io.ReaderAt, off, end int64, f func(carBlock) error) error {
+	cidBuf := make([]byte, maxCidLength)
+	for off < end {
+		start := off
+		l, n, err := readUvarintAt(r, off)
+		if err != nil {
+			return fmt.Errorf("reading block length at %d: %w", off, err)
+		}
+		off += int64(n)
+		if l == 0 || l > uint64(end-off) {
+			return fmt.Errorf("block at %d has an invalid length %d", off, l)
+		}
+		b := cidBuf
+		if l < uint64(len(b)) {
+			b = b[:l]
+		}
+		_, err = r.ReadAt(b, off)
+		if err != nil {
+			return fmt.Errorf("reading cid at %d: %w", off, err)
+		}
+		cidLen, c, err := cid.CidFromBytes(b)
+		if err != nil {
+			return fmt.Errorf("decoding cid at %d: %w", off, err)
+		}
+		err = f(carBlock{
+			Cid:    c,
+			Start:  start,
+			Offset: off + int64(cidLen),
+			Length: int64(l) - int64(cidLen),
+		})
+		if err != nil {
+			return err
+		}
+		off += int64(l)
+	}
+	return nil
+}
+
+func readUvarintAt(r io.ReaderAt, off int64) (uint64, int, error) {
+	var buf [binary.MaxVarintLen64]byte
+	n, err := r.ReadAt(buf[:], off)
+	if n == 0 {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	v, l := binary.Uvarint(buf[:n])
+	if l <= 0 {
+		return 0, 0, errors.New("invalid varint")
+	}
+	return v, l, nil
+}
+
+// isPadBlock reports if b looks like one of the blocks written to align
+// data, real blocks may look the same so only skip it if nothing links it.
+func isPadBlock(b carBlock) bool {
+	if b.Cid.Type() != cid.Raw || b.Length >= int64(len(precomputedEmptyHashes)) {
+		return false
+	}
+	d, err := mh.Decode(b.Cid.Hash())
+	if err != nil || d.Code != mh.SHA2_256 {
+		return false
+	}
+	return bytes.Equal(d.Digest, precomputedEmptyHashes[b.Length][:])
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	carV2PragmaSize = 11
+	carV2HeaderSize = 40
+	// carV2DataOffset keeps the CARv1 payload aligned for reflinking.
+	carV2DataOffset = diskAssumedBlockSize
+
+	multihashIndexSortedCodec = 0x0401
+)
+
+// carV2Pragma is the CARv1 style header telling this is a CARv2.
+var carV2Pragma = [carV2PragmaSize]byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+// carIndexRecord locates a block section (length varint included) from the
+// start of the CARv1 payload.
+type carIndexRecord struct {
+	Cid    cid.Cid
+	Offset int64
+	Length int64
+	// Padding is the length of the padding block following this one.
+	Padding int64
+	// Path is the file or directory the block belongs to, empty for the fake
+	// roots.
+	Path string
+	// Node is set for the dag-pb nodes stored under a raw CID.
+	Node bool
+}
+
+// makeCarV2Header returns the pragma, header and padding up to the data.
+func makeCarV2Header(dataSize, indexOffset uint64) []byte {
+	b := make([]byte, carV2DataOffset)
+	copy(b, carV2Pragma[:])
+	h := b[carV2PragmaSize : carV2PragmaSize+carV2HeaderSize]
+	// The first 16 bytes are the characteristics, none are set.
+	binary.LittleEndian.PutUint64(h[16:], carV2DataOffset)
+	binary.LittleEndian.PutUint64(h[24:], dataSize)
+	binary.LittleEndian.PutUint64(h[32:], indexOffset)
+	return b
+}
+
+// marshalMultihashIndexSorted serialises records as a MultihashIndexSorted
+// index, buckets of multihash codes then of digest widths, each a sorted
+// list of digests followed by their offset, duplicates are dropped.
+func marshalMultihashIndexSorted(records []carIndexRecord) ([]byte, error) {
+	type entry struct {
+		digest []byte
+		offset uint64
+	}
+	buckets := map[uint64]map[uint32][]entry{}
+	for _, r := range records {
+		d, err := mh.Decode(r.Cid.Hash())
+		if err != nil {
+			return nil, err
+		}
+		widths, ok := buckets[d.Code]
+		if !ok {
+			widths = map[uint32][]entry{}
+			buckets[d.Code] = widths
+		}
+		width := uint32(len(d.Digest)) + 8
+		widths[width] = append(widths[width], entry{d.Digest, uint64(r.Offset)})
+	}
+
+	var out bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	out.Write(scratch[:binary.PutUvarint(scratch[:], multihashIndexSortedCodec)])
+	binary.Write(&out, binary.LittleEndian, int32(len(buckets)))
+
+	codes := make([]uint64, 0, len(buckets))
+	for code := range buckets {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, code := range codes {
+		widths := buckets[code]
+		binary.Write(&out, binary.LittleEndian, code)
+		binary.Write(&out, binary.LittleEndian, int32(len(widths)))
+
+		sortedWidths := make([]uint32, 0, len(widths))
+		for w := range widths {
+			sortedWidths = append(sortedWidths, w)
+		}
+		sort.Slice(sortedWidths, func(i, j int) bool { return sortedWidths[i] < sortedWidths[j] })
+		for _, width := range sortedWidths {
+			entries := widths[width]
+			sort.Slice(entries, func(i, j int) bool {
+				if c := bytes.Compare(entries[i].digest, entries[j].digest); c != 0 {
+					return c < 0
+				}
+				return entries[i].offset < entries[j].offset
+			})
+			// Keep the first copy of duplicated blocks.
+			unique := entries[:0]
+			for i, e := range entries {
+				if i != 0 && bytes.Equal(e.digest, unique[len(unique)-1].digest) {
+					continue
+				}
+				unique = append(unique, e)
+			}
+
+			binary.Write(&out, binary.LittleEndian, width)
+			binary.Write(&out, binary.LittleEndian, int64(len(unique))*int64(width))
+			for _, e := range unique {
+				out.Write(e.digest)
+				binary.Write(&out, binary.LittleEndian, e.offset)
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+var errUnsupportedIndex = errors.New("unsupported index codec")
+
+// unmarshalMultihashIndexSorted returns the multihashes and offsets of a
+// MultihashIndexSorted index.
+func unmarshalMultihashIndexSorted(b []byte) (map[string]int64, error) {
+	codec, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errors.New("invalid index codec")
+	}
+	if codec != multihashIndexSortedCodec {
+		return nil, fmt.Errorf("%w 0x%x", errUnsupportedIndex, codec)
+	}
+	r := bytes.NewReader(b[n:])
+	var codes int32
+	err := binary.Read(r, binary.LittleEndian, &codes)
+	if err != nil {
+		return nil, fmt.Errorf("reading bucket count: %w", err)
+	}
+	entries := map[string]int64{}
+	for ; codes > 0; codes-- {
+		var code uint64
+		var widths int32
+		err = binary.Read(r, binary.LittleEndian, &code)
+		if err == nil {
+			err = binary.Read(r, binary.LittleEndian, &widths)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading bucket: %w", err)
+		}
+		for ; widths > 0; widths-- {
+			var width uint32
+			var length int64
+			err = binary.Read(r, binary.LittleEndian, &width)
+			if err == nil {
+				err = binary.Read(r, binary.LittleEndian, &length)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading bucket 0x%x: %w", code, err)
+			}
+			if width <= 8 || length < 0 || length%int64(width) != 0 || length > int64(r.Len()) {
+				return nil, fmt.Errorf("invalid width %d or length %d in bucket 0x%x", width, length, code)
+			}
+			entry := make([]byte, width)
+			for ; length > 0; length -= int64(width) {
+				r.Read(entry)
+				digest := entry[:width-8]
+				hash, err := mh.Encode(digest, code)
+				if err != nil {
+					return nil, fmt.Errorf("encoding digest in bucket 0x%x: %w", code, err)
+				}
+				entries[string(hash)] = int64(binary.LittleEndian.Uint64(entry[width-8:]))
+			}
+		}
+	}
+	return entries, nil
+}
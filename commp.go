@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	// fr32 expands 127 bytes of data into 128 bytes (4 tree leaves).
+	fr32UnpaddedChunk = 127
+	fr32PaddedChunk   = 128
+	commpNodeSize     = 32
+	minPieceSize      = fr32PaddedChunk
+
+	filCommitmentUnsealed    = 0xf101
+	sha2_256Trunc254Padded   = 0x1012
+	commpReadBufferQuadCount = 1 << 13
+)
+
+// commpZeros are the commitments of zero filled subtrees by height.
+var commpZeros [64][commpNodeSize]byte
+
+func init() {
+	for i := 1; i < len(commpZeros); i++ {
+		commpZeros[i] = commpHashNodes(&commpZeros[i-1], &commpZeros[i-1])
+	}
+}
+
+func commpHashNodes(left, right *[commpNodeSize]byte) [commpNodeSize]byte {
+	h := sha256.New()
+	h.Write(left[:])
+	h.Write(right[:])
+	var out [commpNodeSize]byte
+	h.Sum(out[:0])
+	// Truncate to 254 bits so it fits in the field.
+	out[commpNodeSize-1] &= 0x3f
+	return out
+}
+
+// fr32Expand spreads 127 bytes into 4 nodes of 254 bits.
+func fr32Expand(in, out []byte) {
+	copy(out[:32], in[:32])
+	out[31] &= 0x3f
+	for i := 32; i < 64; i++ {
+		out[i] = in[i]<<2 | in[i-1]>>6
+	}
+	out[63] &= 0x3f
+	for i := 64; i < 96; i++ {
+		out[i] = in[i]<<4 | in[i-1]>>4
+	}
+	out[95] &= 0x3f
+	for i := 96; i < 127; i++ {
+		out[i] = in[i]<<6 | in[i-1]>>2
+	}
+	out[127] = in[126] >> 2
+}
+
+// commpTree is a streaming merkle tree, levels hold the left nodes waiting
+// for their sibling.
+type commpTree struct {
+	levels []*[commpNodeSize]byte
+}
+
+func (t *commpTree) add(node [commpNodeSize]byte) {
+	for i := 0; ; i++ {
+		if i == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		if t.levels[i] == nil {
+			n := node
+			t.levels[i] = &n
+			return
+		}
+		node = commpHashNodes(t.levels[i], &node)
+		t.levels[i] = nil
+	}
+}
+
+// root completes the tree up to height with zero subtrees.
+func (t *commpTree) root(height int) [commpNodeSize]byte {
+	var cur *[commpNodeSize]byte
+	for i := 0; i < height; i++ {
+		var left *[commpNodeSize]byte
+		if i < len(t.levels) {
+			left = t.levels[i]
+		}
+		var n [commpNodeSize]byte
+		switch {
+		case left != nil && cur != nil:
+			n = commpHashNodes(left, cur)
+		case left != nil:
+			n = commpHashNodes(left, &commpZeros[i])
+		case cur != nil:
+			n = commpHashNodes(cur, &commpZeros[i])
+		default:
+			continue
+		}
+		cur = &n
+	}
+	if cur == nil {
+		// The data filled the tree exactly.
+		return *t.levels[height]
+	}
+	return *cur
+}
+
+// paddedPieceSize returns the size of the piece holding size bytes of data.
+func paddedPieceSize(size uint64) uint64 {
+	padded := (size + fr32UnpaddedChunk - 1) / fr32UnpaddedChunk * fr32PaddedChunk
+	if padded <= minPieceSize {
+		return minPieceSize
+	}
+	return 1 << bits.Len64(padded-1)
+}
+
+// commpWriter computes the piece CID of the bytes written to it, the car
+// driver feeds it each car in output order while writing it, reading the
+// copied ranges back from the temp car.
+type commpWriter struct {
+	tree commpTree
+	// buf holds the start of a chunk waiting for more bytes.
+	buf  [fr32UnpaddedChunk]byte
+	n    int
+	out  [fr32PaddedChunk]byte
+	size int64
+}
+
+// commpZeroBuffer feeds the holes left by padding blocks.
+var commpZeroBuffer [fr32UnpaddedChunk * 32]byte
+
+func (w *commpWriter) Write(b []byte) (int, error) {
+	l := len(b)
+	w.size += int64(l)
+	if w.n != 0 {
+		c := copy(w.buf[w.n:], b)
+		w.n += c
+		b = b[c:]
+		if w.n != fr32UnpaddedChunk {
+			return l, nil
+		}
+		w.chunk(w.buf[:])
+		w.n = 0
+	}
+	for ; len(b) >= fr32UnpaddedChunk; b = b[fr32UnpaddedChunk:] {
+		w.chunk(b[:fr32UnpaddedChunk])
+	}
+	w.n = copy(w.buf[:], b)
+	return l, nil
+}
+
+func (w *commpWriter) chunk(in []byte) {
+	fr32Expand(in, w.out[:])
+	for i := 0; i != fr32PaddedChunk; i += commpNodeSize {
+		var node [commpNodeSize]byte
+		copy(node[:], w.out[i:])
+		w.tree.add(node)
+	}
+}
+
+// The feed methods do nothing on a nil writer so the car driver can call
+// them whether commp is enabled or not.
+
+func (w *commpWriter) feed(b []byte) {
+	if w == nil {
+		return
+	}
+	w.Write(b)
+}
+
+func (w *commpWriter) feedZeros(n int64) {
+	if w == nil {
+		return
+	}
+	for n != 0 {
+		l := int64(len(commpZeroBuffer))
+		if l > n {
+			l = n
+		}
+		w.Write(commpZeroBuffer[:l])
+		n -= l
+	}
+}
+
+// feedRange feeds n bytes of r at off.
+func (w *commpWriter) feedRange(r io.ReaderAt, off, n int64) error {
+	if w == nil {
+		return nil
+	}
+	buf := make([]byte, fr32UnpaddedChunk*commpReadBufferQuadCount)
+	copied, err := io.CopyBuffer(w, io.NewSectionReader(r, off, n), buf)
+	if err != nil {
+		return fmt.Errorf("reading for commp at %d: %w", off, err)
+	}
+	if copied != n {
+		return fmt.Errorf("reading for commp at %d: %w", off+copied, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// sum returns the piece CID and padded piece size of the data written, it
+// must be called once everything is written.
+func (w *commpWriter) sum() (cid.Cid, uint64, error) {
+	if w.size == 0 {
+		return cid.Undef, 0, fmt.Errorf("no data to compute the commp of")
+	}
+	if w.n != 0 {
+		for i := w.n; i != fr32UnpaddedChunk; i++ {
+			w.buf[i] = 0
+		}
+		w.chunk(w.buf[:])
+		w.n = 0
+	}
+	pieceSize := paddedPieceSize(uint64(w.size))
+	commp := w.tree.root(bits.TrailingZeros64(pieceSize / commpNodeSize))
+	hash, err := mh.Encode(commp[:], sha2_256Trunc254Padded)
+	if err != nil {
+		return cid.Undef, 0, fmt.Errorf("encoding commp: %w", err)
+	}
+	return cid.NewCidV1(filCommitmentUnsealed, hash), pieceSize, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"math/bits"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func commpCid(t *testing.T, commp [commpNodeSize]byte) cid.Cid {
+	t.Helper()
+	hash, err := mh.Encode(commp[:], sha2_256Trunc254Padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(filCommitmentUnsealed, hash)
+}
+
+// Piece CIDs of zero filled pieces, as used by Filecoin for empty sectors.
+var zeroPieceCids = []struct {
+	size uint64
+	cid  string
+}{
+	{2 << 10, "baga6ea4seaqpy7usqklokfx2vxuynmupslkeutzexe2uqurdg5vhtebhxqmpqmy"},
+	{8 << 20, "baga6ea4seaqgl4u6lwmnerwdrm4iz7ag3mpwwaqtapc2fciabpooqmvjypweeha"},
+	{512 << 20, "baga6ea4seaqdsvqopmj2soyhujb72jza76t4wpq5fzifvm3ctz47iyytkewnubq"},
+	{32 << 30, "baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq"},
+	{64 << 30, "baga6ea4seaqomqafu276g53zko4k23xzh4h4uecjwicbmvhsuqi7o4bhthhm4aq"},
+}
+
+func TestCommpZeroPieces(t *testing.T) {
+	for _, tc := range zeroPieceCids {
+		height := bits.TrailingZeros64(tc.size / commpNodeSize)
+		if got := commpCid(t, commpZeros[height]).String(); got != tc.cid {
+			t.Errorf("%d: expected %s, got %s", tc.size, tc.cid, got)
+		}
+		if tc.size > 8<<20 {
+			continue
+		}
+
+		var w commpWriter
+		w.feedZeros(int64(tc.size / fr32PaddedChunk * fr32UnpaddedChunk))
+		c, size, err := w.sum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.String() != tc.cid || size != tc.size {
+			t.Errorf("%d: expected %s, got %s of %d", tc.size, tc.cid, c, size)
+		}
+	}
+}
+
+// fr32Reference inserts two zero bits after every 254 bits, bits are taken
+// least significant first.
+func fr32Reference(in []byte) []byte {
+	out := make([]byte, len(in)/fr32UnpaddedChunk*fr32PaddedChunk)
+	var o int
+	for i := 0; i != len(in)*8; i++ {
+		if o%256 == 254 {
+			o += 2
+		}
+		if in[i/8]>>(i%8)&1 != 0 {
+			out[o/8] |= 1 << (o % 8)
+		}
+		o++
+	}
+	return out
+}
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	var x uint32 = 1
+	for i := range b {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}
+
+func TestFr32Expand(t *testing.T) {
+	out := make([]byte, fr32PaddedChunk)
+	fr32Expand(bytes.Repeat([]byte{0xff}, fr32UnpaddedChunk), out)
+	node := append(bytes.Repeat([]byte{0xff}, commpNodeSize-1), 0x3f)
+	if want := bytes.Repeat(node, 4); !bytes.Equal(out, want) {
+		t.Errorf("all ones: expected %x, got %x", want, out)
+	}
+
+	in := testData(fr32UnpaddedChunk * 16)
+	want := fr32Reference(in)
+	for i := 0; i != len(in); i += fr32UnpaddedChunk {
+		fr32Expand(in[i:i+fr32UnpaddedChunk], out)
+		o := i / fr32UnpaddedChunk * fr32PaddedChunk
+		if !bytes.Equal(out, want[o:o+fr32PaddedChunk]) {
+			t.Fatalf("chunk %d: expected %x, got %x", i/fr32UnpaddedChunk, want[o:o+fr32PaddedChunk], out)
+		}
+	}
+}
+
+// commpReference hashes the whole padded piece level by level.
+func commpReference(data []byte) ([commpNodeSize]byte, uint64) {
+	pieceSize := paddedPieceSize(uint64(len(data)))
+	in := make([]byte, pieceSize/fr32PaddedChunk*fr32UnpaddedChunk)
+	copy(in, data)
+	leaves := fr32Reference(in)
+	level := make([][commpNodeSize]byte, len(leaves)/commpNodeSize)
+	for i := range level {
+		copy(level[i][:], leaves[i*commpNodeSize:])
+	}
+	for len(level) != 1 {
+		next := make([][commpNodeSize]byte, len(level)/2)
+		for i := range next {
+			next[i] = commpHashNodes(&level[2*i], &level[2*i+1])
+		}
+		level = next
+	}
+	return level[0], pieceSize
+}
+
+func TestCommpWriter(t *testing.T) {
+	data := testData(1 << 16)
+	for _, size := range []int{1, 126, 127, 128, 254, 1000, 2032, 2033, 4064, 40000, 1 << 16} {
+		want, wantSize := commpReference(data[:size])
+		for _, split := range []int{1, 7, 127, 128, 4096, size} {
+			var w commpWriter
+			for b := data[:size]; len(b) != 0; {
+				l := split
+				if l > len(b) {
+					l = len(b)
+				}
+				w.feed(b[:l])
+				b = b[l:]
+			}
+			c, pieceSize, err := w.sum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pieceSize != wantSize {
+				t.Errorf("%d by %d: expected piece size %d, got %d", size, split, wantSize, pieceSize)
+			}
+			if want := commpCid(t, want); c != want {
+				t.Errorf("%d by %d: expected %s, got %s", size, split, want, c)
+			}
+		}
+	}
+
+	var w commpWriter
+	if _, _, err := w.sum(); err == nil {
+		t.Error("expected an error for an empty piece")
+	}
+}
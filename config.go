@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flags are taken in order from the command line, then LINUX2IPFS_<FLAG> envs,
+// then the selected profile of the config file and then its top level.
+const envFlagPrefix = "LINUX2IPFS_"
+
+var configHelp = `Config:
+  Any flag not given on the command line can be set by the ` + envFlagPrefix + `<FLAG> env
+  (like ` + envFlagKey("block-target") + `, one value per line for repeatable flags)
+  or by the -config JSON file:
+    {
+      "target": "/srv/data",
+      "flags": {"driver": ["car", "estuary"], "exclude": ["*.tmp"], "dump-throttle": "1m"},
+      "profiles": {"photos": {"target": "/srv/photos", "flags": {"block-target": 1048576}}}
+    }
+  a -profile's target and flags take precedence over the top level ones.
+
+`
+
+func envFlagKey(name string) string {
+	return envFlagPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// isListFlag reports if f can be given multiple times.
+func isListFlag(f *flag.Flag) bool {
+	_, ok := f.Value.(*stringList)
+	return ok
+}
+
+// applyFlagEnvs sets the flags not in set from the envs, set is updated.
+func applyFlagEnvs(fs *flag.FlagSet, set map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		key := envFlagKey(f.Name)
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			return
+		}
+		values := []string{v}
+		if isListFlag(f) {
+			values = strings.Split(strings.TrimRight(v, "\n"), "\n")
+		}
+		for _, v := range values {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("%s: %w", key, e)
+				return
+			}
+		}
+		set[f.Name] = true
+	})
+	return err
+}
+
+type configFile struct {
+	configProfile
+	Profiles map[string]configProfile `json:"profiles"`
+}
+
+type configProfile struct {
+	Target string                 `json:"target"`
+	Flags  map[string]interface{} `json:"flags"`
+}
+
+// applyConfigFile sets the flags not in set from the config file at path,
+// set is updated, it returns the target of the config if any.
+func applyConfigFile(fs *flag.FlagSet, path, profile string, set map[string]bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening config: %w", err)
+	}
+	defer f.Close()
+	var c configFile
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err != nil {
+		return "", fmt.Errorf("decoding config %s: %w", path, err)
+	}
+
+	target := c.Target
+	layers := []map[string]interface{}{}
+	if profile != "" {
+		p, ok := c.Profiles[profile]
+		if !ok {
+			return "", fmt.Errorf("profile %q not found in %s", profile, path)
+		}
+		if p.Target != "" {
+			target = p.Target
+		}
+		layers = append(layers, p.Flags)
+	}
+	layers = append(layers, c.Flags)
+
+	for _, flags := range layers {
+		names := make([]string, 0, len(flags))
+		for name := range flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if set[name] {
+				continue
+			}
+			if name == "config" || name == "profile" {
+				return "", fmt.Errorf("flag %q cannot be set in the config", name)
+			}
+			fl := fs.Lookup(name)
+			if fl == nil {
+				return "", fmt.Errorf("unknown flag %q in the config", name)
+			}
+			values, err := configValues(flags[name])
+			if err != nil {
+				return "", fmt.Errorf("flag %q: %w", name, err)
+			}
+			if len(values) != 1 && !isListFlag(fl) {
+				return "", fmt.Errorf("flag %q expects a single value", name)
+			}
+			for _, v := range values {
+				err = fl.Value.Set(v)
+				if err != nil {
+					return "", fmt.Errorf("flag %q: %w", name, err)
+				}
+			}
+			set[name] = true
+		}
+	}
+	return target, nil
+}
+
+func configValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, e := range v {
+			if _, ok := e.([]interface{}); ok {
+				return nil, fmt.Errorf("nested list")
+			}
+			r, err := configValues(e)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = r[0]
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "error expected: "+os.Args[0]+" config check [flags] [<target file path>]")
+		return 1
+	}
+	validateOnly = true
+	o, ok := parseRunOptions(args[1:], false)
+	if !ok {
+		return 1
+	}
+	for _, d := range o.drivers {
+		err := d.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error closing driver "+d.name+": "+redact(err.Error()))
+			return 1
+		}
+	}
+	fmt.Fprintln(os.Stderr, "config ok, target: "+o.target)
+	return 0
+}
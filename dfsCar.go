@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	pb "github.com/Jorropo/linux2ipfs/pb"
+	"github.com/ipfs/go-cid"
+	"google.golang.org/protobuf/proto"
+)
+
+// dfsCar is the layout of a car written in depth first order, records are
+// relative to the start of the car, headerPad is the padding right after its
+// header and end is where it ends in the output file.
+type dfsCar struct {
+	payload   CarPayload
+	base      int64
+	headerLen int64
+	headerPad int64
+	steps     []dfsStep
+	records   []carIndexRecord
+	end       int64
+}
+
+// dfsStep is a block of a dfsCar, copy blocks are reflinked from the temp
+// car and preceded by pad bytes of padding.
+type dfsStep struct {
+	cid  cid.Cid
+	b    carBlock
+	copy bool
+	pad  int64
+}
+
+// planDFSCar lays payload out at base with each block before the blocks it
+// links, in link order. The fakeroots come first, then each DAG they link
+// starting from its root. The fakeroots link every block of the car in the
+// order they were chunked, which is children first, so a block they link is
+// only walked from them if no other block of the car links it. Blocks are
+// written with the CID they are linked with, blocks not linked from the root
+// are written last and padding blocks are dropped. If align is set, leaves
+// which are aligned in the temp car are preceded by a padding block so they
+// are aligned in the output too and can be reflinked.
+// The whole layout is known before writing so the CARv2 header and the commp
+// can be done in output order.
+func planDFSCar(base int64, payload CarPayload, align bool) (*dfsCar, error) {
+	_, headerLen, err := readCarHeader(payload)
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	blocks := map[string]carBlock{}
+	var order []carBlock
+	err = readCarBlocks(payload, headerLen, payload.Size, func(b carBlock) error {
+		k := string(b.Cid.Hash())
+		if _, ok := blocks[k]; !ok {
+			blocks[k] = b
+		}
+		order = append(order, b)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading blocks: %w", err)
+	}
+	paths := make(map[int64]string, len(payload.Index))
+	// Blocks are stored and linked by the fakeroots under raw CIDs, the
+	// dag-pb nodes are decoded from the index or the CIDs linking them.
+	pending := []cid.Cid{payload.Root}
+	for _, r := range payload.Index {
+		paths[r.Offset] = r.Path
+		if r.Node {
+			pending = append(pending, cid.NewCidV1(cid.DagProtobuf, r.Cid.Hash()))
+		}
+	}
+
+	// Fakeroots are in memory.
+	memLen := int64(len(payload.Header))
+	links := map[string][]cid.Cid{}
+	// linked are the blocks linked by a block which isn't a fakeroot.
+	linked := map[string]struct{}{}
+	for len(pending) != 0 {
+		c := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		k := string(c.Hash())
+		if _, ok := links[k]; ok || c.Type() != cid.DagProtobuf {
+			continue
+		}
+		b, ok := blocks[k]
+		if !ok {
+			continue
+		}
+		data := make([]byte, b.Length)
+		_, err = payload.ReadAt(data, b.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("reading block %s: %w", c, err)
+		}
+		var n pb.PBNode
+		err = proto.Unmarshal(data, &n)
+		if err != nil {
+			return nil, fmt.Errorf("decoding block %s: %w", c, err)
+		}
+		ls := make([]cid.Cid, len(n.Links))
+		for i, l := range n.Links {
+			ls[i], err = cid.Cast(l.Hash)
+			if err != nil {
+				return nil, fmt.Errorf("decoding link %d of %s: %w", i, c, err)
+			}
+			if b.Offset >= memLen {
+				linked[string(ls[i].Hash())] = struct{}{}
+			}
+		}
+		links[k] = ls
+		pending = append(pending, ls...)
+	}
+
+	d := &dfsCar{
+		payload:   payload,
+		base:      base,
+		headerLen: headerLen,
+	}
+	type dfsLink struct {
+		cid cid.Cid
+		// fromFake is set if the link is from a fakeroot.
+		fromFake bool
+	}
+	visited := map[string]struct{}{}
+	stack := []dfsLink{{cid: payload.Root, fromFake: true}}
+	for len(stack) != 0 {
+		l := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		c := l.cid
+		k := string(c.Hash())
+		if _, ok := visited[k]; ok {
+			continue
+		}
+		b, ok := blocks[k]
+		if !ok {
+			// Inlined or in an other car.
+			continue
+		}
+		fake := b.Offset < memLen
+		if _, ok := linked[k]; ok && l.fromFake && !fake {
+			// It is written when walking the block linking it.
+			continue
+		}
+		visited[k] = struct{}{}
+
+		ls, ok := links[k]
+		if !ok {
+			d.steps = append(d.steps, dfsStep{cid: c, b: b, copy: true})
+			continue
+		}
+		d.steps = append(d.steps, dfsStep{cid: c, b: b})
+		for i := len(ls) - 1; i >= 0; i-- {
+			stack = append(stack, dfsLink{cid: ls[i], fromFake: fake})
+		}
+	}
+
+	for _, b := range order {
+		k := string(b.Cid.Hash())
+		if _, ok := visited[k]; ok || isPadBlock(b) {
+			continue
+		}
+		visited[k] = struct{}{}
+		d.steps = append(d.steps, dfsStep{cid: b.Cid, b: b, copy: true})
+	}
+
+	woff := base + headerLen
+	for i := range d.steps {
+		s := &d.steps[i]
+		length := int64(len(sectionHeader(s.cid, s.b.Length))) + s.b.Length
+		if s.copy && s.b.Offset >= memLen {
+			roff := payload.CarOffset + s.b.Offset - memLen
+			if align && !noPad && s.b.Length >= diskAssumedBlockSize && roff%diskAssumedBlockSize == 0 {
+				s.pad = (diskAssumedBlockSize - (woff+length-s.b.Length)%diskAssumedBlockSize) % diskAssumedBlockSize
+				if s.pad != 0 && s.pad < fakeBlockMinLength {
+					// we can't pad so little, pad to the next size
+					s.pad += diskAssumedBlockSize
+				}
+			}
+		}
+		if s.pad != 0 {
+			if l := len(d.records); l != 0 {
+				d.records[l-1].Padding += s.pad
+			} else {
+				d.headerPad += s.pad
+			}
+			woff += s.pad
+		}
+		d.records = append(d.records, carIndexRecord{
+			Cid:    s.cid,
+			Offset: woff - base,
+			Length: length,
+			Path:   paths[s.b.Start],
+		})
+		woff += length
+	}
+	d.end = woff
+	return d, nil
+}
+
+func sectionHeader(c cid.Cid, dataLen int64) []byte {
+	cb := c.Bytes()
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(cb))
+	n := binary.PutUvarint(buf, uint64(len(cb))+uint64(dataLen))
+	return append(buf[:n], cb...)
+}
+
+// write writes the car to out and feeds it to cw.
+func (d *dfsCar) write(out *os.File, cw *commpWriter) error {
+	header := d.payload.Header[:d.headerLen]
+	_, err := out.WriteAt(header, d.base)
+	if err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+	cw.feed(header)
+
+	memLen := int64(len(d.payload.Header))
+	woff := d.base + d.headerLen
+	for _, s := range d.steps {
+		if s.pad != 0 {
+			// The body is left as a hole.
+			padHeader := createPadBlockHeader(uint16(s.pad))
+			_, err := out.WriteAt(padHeader, woff)
+			if err != nil {
+				return fmt.Errorf("writing pad block: %w", err)
+			}
+			cw.feed(padHeader)
+			cw.feedZeros(s.pad - int64(len(padHeader)))
+			woff += s.pad
+		}
+
+		section := sectionHeader(s.cid, s.b.Length)
+		if !s.copy || s.b.Offset < memLen {
+			// Dag-pb nodes are rewritten with the CID they are linked with and
+			// fakeroots are in memory.
+			data := make([]byte, s.b.Length)
+			_, err := d.payload.ReadAt(data, s.b.Offset)
+			if err != nil {
+				return fmt.Errorf("reading block %s: %w", s.cid, err)
+			}
+			section = append(section, data...)
+			_, err = out.WriteAt(section, woff)
+			if err != nil {
+				return fmt.Errorf("writing block %s: %w", s.cid, err)
+			}
+			cw.feed(section)
+			woff += int64(len(section))
+			continue
+		}
+
+		_, err := out.WriteAt(section, woff)
+		if err != nil {
+			return fmt.Errorf("writing block %s: %w", s.cid, err)
+		}
+		cw.feed(section)
+		woff += int64(len(section))
+		roff := d.payload.CarOffset + s.b.Offset - memLen
+		err = copyFileRange(out, woff, d.payload.Car, roff, s.b.Length)
+		if err != nil {
+			return fmt.Errorf("copying block %s: %w", s.cid, err)
+		}
+		err = cw.feedRange(d.payload.Car, roff, s.b.Length)
+		if err != nil {
+			return err
+		}
+		woff += s.b.Length
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/Jorropo/linux2ipfs/pb"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	"google.golang.org/protobuf/proto"
+)
+
+func testCid(t *testing.T, codec uint64, data []byte) cid.Cid {
+	t.Helper()
+	h := sha256.Sum256(data)
+	hash, err := mh.Encode(h[:], mh.SHA2_256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(codec, hash)
+}
+
+func testPBNode(t *testing.T, links ...cid.Cid) []byte {
+	t.Helper()
+	n := &pb.PBNode{Data: directoryData}
+	for _, l := range links {
+		n.Links = append(n.Links, &pb.PBLink{Hash: l.Bytes()})
+	}
+	data, err := proto.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestDFSCarOrder lays out a payload like makeSendPayload does, blocks stored
+// back to front under raw CIDs and a fake root linking them in the order they
+// were chunked, and checks each dag-pb node is written before what it links.
+func TestDFSCarOrder(t *testing.T) {
+	chunkA, chunkB, single, orphan := []byte("chunk a"), []byte("chunk b"), []byte("single block file"), []byte("orphan")
+	file := testPBNode(t, testCid(t, cid.Raw, chunkA), testCid(t, cid.Raw, chunkB))
+	dir := testPBNode(t, testCid(t, cid.DagProtobuf, file), testCid(t, cid.Raw, single))
+	// In the order they were chunked.
+	blocks := []struct {
+		data []byte
+		node bool
+	}{{chunkA, false}, {chunkB, false}, {file, true}, {single, false}, {dir, true}}
+	// nodes are the dag-pb CIDs of the nodes and the fake root.
+	nodes := map[string]cid.Cid{}
+
+	var fakeLinks []cid.Cid
+	for _, b := range blocks {
+		c := testCid(t, cid.Raw, b.data)
+		fakeLinks = append(fakeLinks, c)
+		if b.node {
+			nodes[string(c.Hash())] = testCid(t, cid.DagProtobuf, b.data)
+		}
+	}
+	fake := testPBNode(t, fakeLinks...)
+	root := testCid(t, cid.DagProtobuf, fake)
+	nodes[string(root.Hash())] = root
+
+	headerBuffer, err := cbor.DumpObject(carHeader{Roots: []cid.Cid{root}, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, binary.MaxVarintLen64)
+	header = append(header[:binary.PutUvarint(header, uint64(len(headerBuffer)))], headerBuffer...)
+	header = append(header, sectionHeader(root, int64(len(fake)))...)
+	header = append(header, fake...)
+
+	var body []byte
+	var index []carIndexRecord
+	add := func(data []byte, node bool) {
+		section := append(sectionHeader(testCid(t, cid.Raw, data), int64(len(data))), data...)
+		index = append(index, carIndexRecord{
+			Cid:    testCid(t, cid.Raw, data),
+			Offset: int64(len(header) + len(body)),
+			Length: int64(len(section)),
+			Node:   node,
+		})
+		body = append(body, section...)
+	}
+	// The temp car is written back to front.
+	for i := len(blocks) - 1; i >= 0; i-- {
+		add(blocks[i].data, blocks[i].node)
+	}
+	add(orphan, false)
+
+	payload := newTestPayload(t, header, body)
+	payload.Root = root
+	payload.Index = index
+
+	d, err := planDFSCar(0, payload, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	err = d.write(out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written []carBlock
+	pos := map[string]int{}
+	err = readCarBlocks(out, d.headerLen, d.end, func(b carBlock) error {
+		pos[string(b.Cid.Hash())] = len(written)
+		written = append(written, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != len(blocks)+2 {
+		t.Fatalf("expected %d blocks, got %d", len(blocks)+2, len(written))
+	}
+	if k := string(written[len(written)-1].Cid.Hash()); k != string(testCid(t, cid.Raw, orphan).Hash()) {
+		t.Error("the block not linked from the root isn't last")
+	}
+
+	for i, b := range written {
+		c, ok := nodes[string(b.Cid.Hash())]
+		if !ok {
+			continue
+		}
+		data := make([]byte, b.Length)
+		_, err := out.ReadAt(data, b.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n pb.PBNode
+		err = proto.Unmarshal(data, &n)
+		if err != nil {
+			t.Fatalf("decoding %s: %v", c, err)
+		}
+		for _, l := range n.Links {
+			lc, err := cid.Cast(l.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j := pos[string(lc.Hash())]; j <= i {
+				t.Errorf("%s at %d is linked by %s at %d", lc, j, c, i)
+			}
+		}
+	}
+}
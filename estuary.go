@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"strconv"
 )
 
 const (
@@ -22,7 +20,7 @@ var estuaryDriverCreator = driverCreator{
 
 func estuaryHelp(out io.Writer) {
 	fmt.Fprint(out, `  Environ:
-  - `+envEstuaryKeyKey+` estuary API key
+  - `+envEstuaryKeyKey+` estuary API key (secret)
   - `+envEstuaryShuttleKey+` shuttle domain
 
 `)
@@ -33,7 +31,10 @@ func newEstuaryDriver(input string) (driver, error) {
 		return nil, fmt.Errorf("non empty estuary argument: %q", input)
 	}
 
-	key := os.Getenv(envEstuaryKeyKey)
+	key, err := getSecret(envEstuaryKeyKey)
+	if err != nil {
+		return nil, err
+	}
 	shuttle := os.Getenv(envEstuaryShuttleKey)
 
 	if key == "" {
@@ -43,45 +44,16 @@ func newEstuaryDriver(input string) (driver, error) {
 		return nil, fmt.Errorf("error empty " + envEstuaryShuttleKey + " envKey")
 	}
 
-	d := &estuaryDriver{
-		key:     key,
-		shuttle: "https://" + shuttle + "/content/add-car",
-	}
-	return d.send, nil
-}
-
-type estuaryDriver struct {
-	shuttle string
-	key     string
-
-	client http.Client
-}
-
-func (e *estuaryDriver) send(headerBuffer []byte, car *os.File, carOffset int64) error {
-	_, err := car.Seek(carOffset, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("error seeking temp file: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", e.shuttle, io.MultiReader(bytes.NewReader(headerBuffer), car))
-	if err != nil {
-		return fmt.Errorf("creating the request failed: %w", err)
-	}
-
-	req.Header.Set("User-Agent", userAgent)
-	req.Header.Set("Content-Type", "application/vnd.ipld.car")
-	req.Header.Set("Authorization", "Bearer "+e.key)
-	req.Header.Set("Content-Length", strconv.FormatUint(uint64(int64(len(headerBuffer))+carMaxSize-carOffset), 10))
-
-	resp, err := e.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("posting failed: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("non 200 result code: %d / body: %s", resp.StatusCode, string(b))
-	}
-
-	return nil
+	return &httpDriver{
+		urlTemplate: "https://" + shuttle + "/content/add-car",
+		method:      "POST",
+		header: http.Header{
+			"Content-Type":  {"application/vnd.ipld.car"},
+			"Authorization": {"Bearer " + key},
+		},
+		expected: []int{200},
+		cidPath:  jsonPath{"cid"},
+		info:     map[string]jsonPath{"estuaryId": {"estuaryId"}},
+		client:   newHTTPClient(),
+	}, nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	envExecRootKey = "LINUX2IPFS_ROOT"
+	envExecSizeKey = "LINUX2IPFS_SIZE"
+	envExecSeqKey  = "LINUX2IPFS_SEQ"
+
+	// maxExecStdout is how much of the command stdout is kept for the receipt.
+	maxExecStdout = 1024 * 64 // 64KiB
+)
+
+var execDriverCreator = driverCreator{
+	factory:    newExecDriver,
+	help:       execHelp,
+	maxCarSize: 1 << 42,
+}
+
+func execHelp(out io.Writer) {
+	fmt.Fprint(out, `  Positional:
+  - <COMMAND> REQUIRED, run with "sh -c" for each car with the car on stdin,
+    a non zero exit code fails the upload and the first 64KiB of stdout are
+    saved in the receipt
+  Environ given to the command:
+  - `+envExecRootKey+` root cid of the car
+  - `+envExecSizeKey+` size of the car in bytes
+  - `+envExecSeqKey+` number of the car in this run
+
+`)
+}
+
+func newExecDriver(input string) (driver, error) {
+	// The whole input is the command, it is likely to contain commas.
+	if input == "" {
+		return nil, fmt.Errorf("empty exec command")
+	}
+	return &execDriver{command: input}, nil
+}
+
+type execDriver struct {
+	command string
+}
+
+func (e *execDriver) Send(ctx context.Context, payload CarPayload) (Receipt, error) {
+	stdout := limitedBuffer{limit: maxExecStdout}
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.command)
+	cmd.Stdin = payload.Reader(ctx)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		envExecRootKey+"="+payload.Root.String(),
+		envExecSizeKey+"="+strconv.FormatInt(payload.Size, 10),
+		envExecSeqKey+"="+strconv.FormatUint(payload.Seq, 10),
+	)
+
+	err := cmd.Run()
+	if err != nil {
+		return Receipt{}, fmt.Errorf("running %q: %w", e.command, err)
+	}
+
+	return Receipt{Info: map[string]string{
+		"stdout": strings.TrimSpace(stdout.String()),
+	}}, nil
+}
+
+func (*execDriver) Close() error {
+	return nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so the writer isn't failed for writing too much. The buffer isn't
+// embedded so its ReadFrom doesn't bypass the limit in io.Copy.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:room])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
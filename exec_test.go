@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestExecSend(t *testing.T) {
+	payload := newTestPayload(t, []byte("header"), []byte("body"))
+	for _, tc := range []struct {
+		name    string
+		command string
+		stdout  string
+		err     bool
+	}{
+		{name: "stdin and environ", command: `cat; echo " $LINUX2IPFS_SEQ $LINUX2IPFS_SIZE"`, stdout: "headerbody 0 10"},
+		{name: "limited stdout", command: `cat >/dev/null; yes | head -c 1000000`, stdout: strings.Repeat("y\n", maxExecStdout/2)},
+		{name: "failure", command: `cat >/dev/null; exit 3`, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := newExecDriver(tc.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receipt, err := d.Send(context.Background(), payload)
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := receipt.Info["stdout"]; got != strings.TrimSpace(tc.stdout) {
+				t.Errorf("expected stdout of %d bytes, got %d: %.40q", len(tc.stdout), len(got), got)
+			}
+		})
+	}
+}
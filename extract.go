@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	pb "github.com/Jorropo/linux2ipfs/pb"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const extractHelp = `Extract:
+  ` + "%[1]s" + ` extract <root CID> <output path> <car path>...
+  Rebuilds the UnixFS DAG of root CID found in CARv1 and CARv2 files at
+  output path, which must not exist. Leaves are copied with copy_file_range
+  so the ones aligned in the cars are reflinked on filesystems supporting
+  it. Blocks aren't rehashed, use verify for that.
+
+`
+
+// extractBlock locates the data of a block in one of the cars.
+type extractBlock struct {
+	car    *os.File
+	offset int64
+	length int64
+}
+
+type extractor struct {
+	blocks map[string]extractBlock
+
+	dirs, files, symlinks int
+	leafBytes, aligned    int64
+}
+
+func extractCommand(args []string) int {
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, extractHelp, os.Args[0])
+		return 1
+	}
+	root, err := cid.Decode(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error decoding root: "+err.Error())
+		return 1
+	}
+
+	e := extractor{blocks: map[string]extractBlock{}}
+	for _, p := range args[2:] {
+		f, err := os.Open(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error opening car: "+err.Error())
+			return 1
+		}
+		defer f.Close()
+		err = e.indexCar(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading "+p+": "+err.Error())
+			return 1
+		}
+	}
+
+	err = e.extract(root, args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error extracting: "+err.Error())
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "extracted %s to %s: %d dirs, %d files, %d symlinks, %d of %d leaf bytes aligned for reflinking\n", root, args[1], e.dirs, e.files, e.symlinks, e.aligned, e.leafBytes)
+	return 0
+}
+
+// indexCar adds the blocks of f to e.
+func (e *extractor) indexCar(f *os.File) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	layout, err := readCarLayout(f, st.Size())
+	if err != nil {
+		return err
+	}
+	data := io.NewSectionReader(f, layout.DataOffset, layout.DataSize)
+	_, off, err := readCarHeader(data)
+	if err != nil {
+		return err
+	}
+	return readCarBlocks(data, off, layout.DataSize, func(b carBlock) error {
+		k := string(b.Cid.Hash())
+		if _, ok := e.blocks[k]; !ok {
+			e.blocks[k] = extractBlock{f, layout.DataOffset + b.Offset, b.Length}
+		}
+		return nil
+	})
+}
+
+// read returns the data of c, inlined or from the cars.
+func (e *extractor) read(c cid.Cid) ([]byte, error) {
+	if c.Prefix().MhType == mh.IDENTITY {
+		d, err := mh.Decode(c.Hash())
+		if err != nil {
+			return nil, err
+		}
+		return d.Digest, nil
+	}
+	b, ok := e.blocks[string(c.Hash())]
+	if !ok {
+		return nil, fmt.Errorf("block %s isn't in the cars", c)
+	}
+	data := make([]byte, b.length)
+	_, err := b.car.ReadAt(data, b.offset)
+	if err != nil {
+		return nil, fmt.Errorf("reading block %s: %w", c, err)
+	}
+	return data, nil
+}
+
+func (e *extractor) node(c cid.Cid) (*pb.PBNode, *pb.UnixfsData, error) {
+	data, err := e.read(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, u, err := decodeUnixfs(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding %s: %w", c, err)
+	}
+	return n, u, nil
+}
+
+// extract writes the DAG of root at path, parents are created before their
+// children.
+func (e *extractor) extract(root cid.Cid, path string) error {
+	type item struct {
+		c    cid.Cid
+		path string
+		// shard is set for the HAMT shards under a directory.
+		shard bool
+	}
+	stack := []item{{c: root, path: path}}
+	for len(stack) != 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if it.c.Type() != cid.DagProtobuf {
+			err := e.writeFile(it.c, it.path, -1)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		n, u, err := e.node(it.c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", it.path, err)
+		}
+		switch u.GetType() {
+		case pb.UnixfsData_Directory, pb.UnixfsData_HAMTShard:
+			if !it.shard {
+				err = os.Mkdir(it.path, 0o755)
+				if err != nil {
+					return err
+				}
+				e.dirs++
+			}
+			hamt := u.GetType() == pb.UnixfsData_HAMTShard
+			for j := len(n.Links) - 1; j >= 0; j-- {
+				l, _ := cid.Cast(n.Links[j].Hash)
+				name := n.Links[j].GetName()
+				if hamt {
+					if len(name) == 2 {
+						// An other level of the same directory.
+						stack = append(stack, item{c: l, path: it.path, shard: true})
+						continue
+					}
+					name = name[2:]
+				}
+				if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+					return fmt.Errorf("unsafe name %q in %s", name, it.path)
+				}
+				stack = append(stack, item{c: l, path: it.path + "/" + name})
+			}
+		case pb.UnixfsData_File, pb.UnixfsData_Raw:
+			err = e.writeFile(it.c, it.path, int64(u.GetFilesize()))
+			if err != nil {
+				return err
+			}
+		case pb.UnixfsData_Symlink:
+			err = os.Symlink(string(u.Data), it.path)
+			if err != nil {
+				return err
+			}
+			e.symlinks++
+		default:
+			return fmt.Errorf("unsupported UnixFS type %s of %s", u.GetType(), it.path)
+		}
+	}
+	return nil
+}
+
+// writeFile creates path with the data of the file DAG c, size is checked
+// if it isn't -1.
+func (e *extractor) writeFile(c cid.Cid, path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	end, err := e.writeFileDAG(f, 0, c)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if size != -1 && end != size {
+		return fmt.Errorf("%s is %d bytes but its DAG holds %d", path, size, end)
+	}
+	e.files++
+	return f.Close()
+}
+
+// writeFileDAG writes the data of the DAG c at off in out and returns where
+// it ends.
+func (e *extractor) writeFileDAG(out *os.File, off int64, c cid.Cid) (int64, error) {
+	if c.Type() != cid.DagProtobuf {
+		if c.Prefix().MhType == mh.IDENTITY {
+			data, err := e.read(c)
+			if err != nil {
+				return 0, err
+			}
+			_, err = out.WriteAt(data, off)
+			return off + int64(len(data)), err
+		}
+		b, ok := e.blocks[string(c.Hash())]
+		if !ok {
+			return 0, fmt.Errorf("block %s isn't in the cars", c)
+		}
+		err := copyFileRange(out, off, b.car, b.offset, b.length)
+		if err != nil {
+			return 0, fmt.Errorf("copying block %s: %w", c, err)
+		}
+		e.leafBytes += b.length
+		if b.offset%diskAssumedBlockSize == 0 && off%diskAssumedBlockSize == 0 {
+			e.aligned += b.length
+		}
+		return off + b.length, nil
+	}
+
+	n, u, err := e.node(c)
+	if err != nil {
+		return 0, err
+	}
+	if t := u.GetType(); t != pb.UnixfsData_File && t != pb.UnixfsData_Raw {
+		return 0, fmt.Errorf("%s is a %s in a file", c, t)
+	}
+	if len(u.Data) != 0 {
+		_, err = out.WriteAt(u.Data, off)
+		if err != nil {
+			return 0, err
+		}
+		off += int64(len(u.Data))
+	}
+	for _, l := range n.Links {
+		lc, _ := cid.Cast(l.Hash)
+		off, err = e.writeFileDAG(out, off, lc)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return off, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// pathFilter selects which entries of the target are added, patterns
+// containing a / are matched against the path relative to the target, others
+// against the name only.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+func newPathFilter(include, exclude []string) (pathFilter, error) {
+	for _, patterns := range [...][]string{include, exclude} {
+		for _, p := range patterns {
+			_, err := path.Match(p, "")
+			if err != nil {
+				return pathFilter{}, fmt.Errorf("pattern %q: %w", p, err)
+			}
+		}
+	}
+	return pathFilter{include: include, exclude: exclude}, nil
+}
+
+func (f pathFilter) empty() bool {
+	return len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// match reports if the entry at rel must be added, excludes apply to
+// everything while includes only apply to non directories.
+func (f pathFilter) match(rel string, isDir bool) bool {
+	for _, p := range f.exclude {
+		if matchPattern(p, rel) {
+			return false
+		}
+	}
+	if isDir || len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(p, rel string) bool {
+	var ok bool
+	if strings.Contains(p, "/") {
+		ok, _ = path.Match(strings.TrimPrefix(p, "/"), rel)
+	} else {
+		ok, _ = path.Match(p, path.Base(rel))
+	}
+	return ok
+}
+
+// String is saved in the incremental file to know when the rules changed.
+func (f pathFilter) String() string {
+	if f.empty() {
+		return ""
+	}
+	return "include:" + strings.Join(f.include, "\n") + "\nexclude:" + strings.Join(f.exclude, "\n")
+}
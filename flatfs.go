@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	pb "github.com/Jorropo/linux2ipfs/pb"
+	"github.com/ipfs/go-cid"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultFlatfsShard = "next-to-last/2"
+	defaultFlatfsPins  = "linux2ipfs.pins"
+	flatfsShardPrefix  = "/repo/flatfs/shard/v1/"
+)
+
+var flatfsDriverCreator = driverCreator{
+	factory:    newFlatfsDriver,
+	help:       flatfsHelp,
+	maxCarSize: 1 << 42,
+}
+
+func flatfsHelp(out io.Writer) {
+	fmt.Fprint(out, `  Positional:
+  - <REPO> REQUIRED, kubo repo (like ~/.ipfs), blocks are written in <REPO>/blocks
+  Options:
+  - shard=<FUNC> sharding of a new blockstore, defaults to "`+defaultFlatfsShard+`"
+  - pins=<PATH> file car roots are appended to, defaults to "<REPO>/`+defaultFlatfsPins+`"
+  - sync=<bool> fsync each block like kubo does, defaults to true
+
+`)
+}
+
+func newFlatfsDriver(input string) (driver, error) {
+	repo, opts, err := parseDriverParams(input)
+	if err != nil {
+		return nil, err
+	}
+	if repo == "" {
+		return nil, fmt.Errorf("empty flatfs repo")
+	}
+	repo = strings.TrimSuffix(repo, "/")
+
+	d := &flatfsDriver{
+		blocks: repo + "/blocks",
+		pins:   opts.take("pins", repo+"/"+defaultFlatfsPins),
+	}
+	d.sync, err = opts.takeBool("sync", true)
+	if err != nil {
+		return nil, err
+	}
+	shard := opts.take("shard", "")
+	err = opts.done()
+	if err != nil {
+		return nil, err
+	}
+
+	shardingFile := d.blocks + "/SHARDING"
+	current, err := os.ReadFile(shardingFile)
+	switch {
+	case err == nil:
+		existing := strings.TrimPrefix(strings.TrimSpace(string(current)), flatfsShardPrefix)
+		if shard != "" && shard != existing {
+			return nil, fmt.Errorf("option shard: %q is already sharded with %q", d.blocks, existing)
+		}
+		shard = existing
+	case os.IsNotExist(err):
+		if shard == "" {
+			shard = defaultFlatfsShard
+		}
+		d.shard, err = parseFlatfsShard(shard)
+		if err != nil {
+			return nil, err
+		}
+		if validateOnly {
+			return d, nil
+		}
+		err = os.MkdirAll(d.blocks, 0o755)
+		if err != nil {
+			return nil, fmt.Errorf("creating blockstore: %w", err)
+		}
+		err = os.WriteFile(shardingFile, []byte(flatfsShardPrefix+shard+"\n"), 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("writing SHARDING: %w", err)
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("reading SHARDING: %w", err)
+	}
+
+	d.shard, err = parseFlatfsShard(shard)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// parseFlatfsShard parses the sharding functions of go-ds-flatfs, they
+// return the directory of a key.
+func parseFlatfsShard(s string) (func(key string) string, error) {
+	name, param, _ := strings.Cut(s, "/")
+	n, err := strconv.Atoi(param)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid flatfs shard %q", s)
+	}
+	padding := strings.Repeat("_", n)
+	switch name {
+	case "prefix":
+		return func(key string) string {
+			return (key + padding)[:n]
+		}, nil
+	case "suffix":
+		return func(key string) string {
+			str := padding + key
+			return str[len(str)-n:]
+		}, nil
+	case "next-to-last":
+		return func(key string) string {
+			str := padding + key
+			offset := len(str) - n - 1
+			return str[offset : offset+n]
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown flatfs shard %q", s)
+	}
+}
+
+var flatfsKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type flatfsDriver struct {
+	blocks string
+	pins   string
+	shard  func(key string) string
+	sync   bool
+}
+
+func (f *flatfsDriver) Send(ctx context.Context, payload CarPayload) (Receipt, error) {
+	header, off, err := readCarHeader(payload)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	// Collect what is linked so padding can be told apart from real blocks
+	// that happen to be zeros.
+	linked := make(map[string]struct{})
+	for _, c := range header.Roots {
+		linked[string(c.Hash())] = struct{}{}
+	}
+	var blocks []carBlock
+	err = readCarBlocks(payload, off, payload.Size, func(b carBlock) error {
+		blocks = append(blocks, b)
+		if b.Cid.Type() != cid.DagProtobuf {
+			return nil
+		}
+		data := make([]byte, b.Length)
+		_, err := payload.ReadAt(data, b.Offset)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", b.Cid, err)
+		}
+		var node pb.PBNode
+		err = proto.Unmarshal(data, &node)
+		if err != nil {
+			return fmt.Errorf("decoding %s: %w", b.Cid, err)
+		}
+		for _, l := range node.Links {
+			c, err := cid.Cast(l.Hash)
+			if err != nil {
+				return fmt.Errorf("decoding link in %s: %w", b.Cid, err)
+			}
+			linked[string(c.Hash())] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	var written, existing, padding int
+	for _, b := range blocks {
+		if err := ctx.Err(); err != nil {
+			return Receipt{}, err
+		}
+		if _, ok := linked[string(b.Cid.Hash())]; !ok && isPadBlock(b) {
+			padding++
+			continue
+		}
+		new, err := f.put(payload, b)
+		if err != nil {
+			return Receipt{}, err
+		}
+		if new {
+			written++
+		} else {
+			existing++
+		}
+	}
+
+	pins, err := os.OpenFile(f.pins, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("opening pins: %w", err)
+	}
+	_, err = pins.Write([]byte(payload.Root.String() + "\n"))
+	if err2 := pins.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return Receipt{}, fmt.Errorf("writing pins: %w", err)
+	}
+
+	return Receipt{Info: map[string]string{
+		"blocks":   f.blocks,
+		"written":  strconv.Itoa(written),
+		"existing": strconv.Itoa(existing),
+		"padding":  strconv.Itoa(padding),
+	}}, nil
+}
+
+// put writes b if it isn't already in the blockstore, the data is
+// reflinked from the temp car when the filesystem allows it.
+func (f *flatfsDriver) put(payload CarPayload, b carBlock) (bool, error) {
+	key := flatfsKeyEncoding.EncodeToString(b.Cid.Hash())
+	dir := f.blocks + "/" + f.shard(key)
+	path := dir + "/" + key + ".data"
+	_, err := os.Lstat(path)
+	if err == nil {
+		return false, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, fmt.Errorf("checking %q: %w", path, err)
+	}
+
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return false, fmt.Errorf("creating shard: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "put-")
+	if err != nil {
+		return false, fmt.Errorf("creating temp block: %w", err)
+	}
+	if headerLen := int64(len(payload.Header)); b.Offset >= headerLen {
+		err = copyFileRange(tmp, 0, payload.Car, payload.CarOffset+b.Offset-headerLen, b.Length)
+	} else {
+		_, err = io.Copy(tmp, io.NewSectionReader(payload, b.Offset, b.Length))
+	}
+	if err == nil && f.sync {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false, fmt.Errorf("writing %q: %w", path, err)
+	}
+	return true, nil
+}
+
+func (*flatfsDriver) Close() error {
+	return nil
+}
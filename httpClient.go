@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// httpTransport is shared by all HTTP based drivers, it is built from the
+// flags before drivers are created.
+var httpTransport *http.Transport
+
+type httpClientOptions struct {
+	proxy string
+	ca    string
+	cert  string
+	key   string
+
+	dialTimeout time.Duration
+	tlsTimeout  time.Duration
+	idleTimeout time.Duration
+
+	http2 bool
+}
+
+func (o httpClientOptions) transport() (*http.Transport, error) {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   o.dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   o.tlsTimeout,
+		IdleConnTimeout:       o.idleTimeout,
+		MaxIdleConns:          100,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     o.http2,
+		TLSClientConfig:       &tls.Config{},
+	}
+	if !o.http2 {
+		// A non nil empty map disables HTTP/2.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	switch o.proxy {
+	case "":
+	case "none":
+		t.Proxy = nil
+	default:
+		u, err := url.Parse(o.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy: %w", err)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	if o.ca != "" {
+		pem, err := os.ReadFile(o.ca)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %q", o.ca)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+
+	if (o.cert == "") != (o.key == "") {
+		return nil, errors.New("client certificate and key must be given together")
+	}
+	if o.cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// baseTransport returns the shared transport, drivers needing to tweak it
+// must Clone it.
+func baseTransport() *http.Transport {
+	if httpTransport == nil {
+		return http.DefaultTransport.(*http.Transport)
+	}
+	return httpTransport
+}
+
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: baseTransport()}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var httpDriverCreator = driverCreator{
+	factory:    newHTTPDriver,
+	help:       httpHelp,
+	maxCarSize: 1 << 42,
+}
+
+func httpHelp(out io.Writer) {
+	fmt.Fprint(out, `  Options:
+  - url=<TEMPLATE> REQUIRED, {root} and {n} are replaced by the car root and number
+  - method=<METHOD> defaults to POST
+  - header=<Name: value>[;<Name: value>...] extra request headers, commas and
+    semicolons in values are escaped with a backslash: header=Accept: a\, b
+  - auth=<bearer|basic>:<ENV> send the bearer token or user:password found in ENV
+  - status=<code>[;<code>...] expected status codes, defaults to 200
+  - cid=<JSONPATH> where the returned cid is in the JSON response, it is checked against the car root
+  - info=<name>:<JSONPATH>[;...] values of the JSON response to keep in the receipt
+
+`)
+}
+
+func newHTTPDriver(input string) (driver, error) {
+	positional, opts, err := parseDriverParams(input)
+	if err != nil {
+		return nil, err
+	}
+	if positional != "" {
+		return nil, fmt.Errorf("unexpected http positional argument: %q, use url=", positional)
+	}
+
+	d := &httpDriver{
+		urlTemplate: opts.take("url", ""),
+		method:      opts.take("method", "POST"),
+		header:      http.Header{"Content-Type": {"application/vnd.ipld.car"}},
+		expected:    []int{200},
+		info:        map[string]jsonPath{},
+		client:      newHTTPClient(),
+	}
+	if d.urlTemplate == "" {
+		return nil, fmt.Errorf("missing url option")
+	}
+
+	if headers := opts.take("header", ""); headers != "" {
+		for _, h := range splitEscaped(headers, ';') {
+			k, v, ok := strings.Cut(h, ":")
+			if !ok {
+				return nil, fmt.Errorf("header %q isn't of the form Name: value", h)
+			}
+			d.header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+		}
+	}
+	if auth := opts.take("auth", ""); auth != "" {
+		typ, env, ok := strings.Cut(auth, ":")
+		if !ok {
+			return nil, fmt.Errorf("auth %q isn't of the form <bearer|basic>:<ENV>", auth)
+		}
+		secret, err := getSecret(env)
+		if err != nil {
+			return nil, err
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("error empty " + env + " envKey")
+		}
+		switch typ {
+		case "bearer":
+			d.header.Set("Authorization", "Bearer "+secret)
+		case "basic":
+			encoded := base64.StdEncoding.EncodeToString([]byte(secret))
+			registerSecret(encoded)
+			d.header.Set("Authorization", "Basic "+encoded)
+		default:
+			return nil, fmt.Errorf("unknown auth type %q", typ)
+		}
+	}
+	if status := opts.take("status", ""); status != "" {
+		d.expected = nil
+		for _, v := range strings.Split(status, ";") {
+			code, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("option status: %w", err)
+			}
+			d.expected = append(d.expected, code)
+		}
+	}
+	if p := opts.take("cid", ""); p != "" {
+		d.cidPath, err = parseJSONPath(p)
+		if err != nil {
+			return nil, fmt.Errorf("option cid: %w", err)
+		}
+	}
+	if info := opts.take("info", ""); info != "" {
+		for _, v := range strings.Split(info, ";") {
+			name, p, ok := strings.Cut(v, ":")
+			if !ok {
+				return nil, fmt.Errorf("info %q isn't of the form <name>:<JSONPATH>", v)
+			}
+			d.info[name], err = parseJSONPath(p)
+			if err != nil {
+				return nil, fmt.Errorf("option info %s: %w", name, err)
+			}
+		}
+	}
+	err = opts.done()
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// httpDriver sends each car as the body of an HTTP request, most car
+// accepting services can be configured through it.
+type httpDriver struct {
+	urlTemplate string
+	method      string
+	header      http.Header
+	expected    []int
+	// cidPath is where the returned cid is found in the response, nil if it
+	// doesn't return one.
+	cidPath jsonPath
+	info    map[string]jsonPath
+
+	client *http.Client
+}
+
+func (h *httpDriver) Send(ctx context.Context, payload CarPayload) (Receipt, error) {
+	req, err := http.NewRequestWithContext(ctx, h.method, expandCarTemplate(h.urlTemplate, payload), payload.Reader(ctx))
+	if err != nil {
+		return Receipt{}, fmt.Errorf("creating the request failed: %w", err)
+	}
+
+	for k, v := range h.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.ContentLength = payload.Size
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("%s failed: %w", strings.ToLower(h.method), err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if !h.isExpected(resp.StatusCode) {
+		return Receipt{}, fmt.Errorf("unexpected result code: %d / body: %s", resp.StatusCode, string(b))
+	}
+	if err != nil {
+		return Receipt{}, fmt.Errorf("reading response: %w", err)
+	}
+
+	info := map[string]string{}
+	if h.cidPath == nil && len(h.info) == 0 {
+		return Receipt{Info: info}, nil
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var res interface{}
+	err = d.Decode(&res)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("decoding response %q: %w", string(b), err)
+	}
+	if h.cidPath != nil {
+		c, ok := h.cidPath.get(res).(string)
+		if !ok {
+			return Receipt{}, fmt.Errorf("no cid at %s in response %q", h.cidPath, string(b))
+		}
+		err = checkReturnedCid(c, payload.Root)
+		if err != nil {
+			return Receipt{}, err
+		}
+		info["cid"] = c
+	}
+	for name, p := range h.info {
+		switch v := p.get(res).(type) {
+		case nil:
+		case string:
+			info[name] = v
+		default:
+			j, _ := json.Marshal(v)
+			info[name] = string(j)
+		}
+	}
+
+	return Receipt{Info: info}, nil
+}
+
+func (h *httpDriver) isExpected(code int) bool {
+	for _, v := range h.expected {
+		if v == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (*httpDriver) Close() error {
+	return nil
+}
+
+// jsonPath is a parsed subset of JSONPath made of object keys (string) and
+// array indexes (int), like $.a.b[0] or $['a'].
+type jsonPath []interface{}
+
+func parseJSONPath(p string) (jsonPath, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("JSONPath %q doesn't start with $", p)
+	}
+	r := jsonPath{}
+	s := p[1:]
+	for s != "" {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in JSONPath %q", p)
+			}
+			r = append(r, s[:end])
+			s = s[end:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in JSONPath %q", p)
+			}
+			v := s[1:end]
+			s = s[end+1:]
+			if len(v) >= 2 && (v[0] == '\'' || v[0] == '"') && v[len(v)-1] == v[0] {
+				r = append(r, v[1:len(v)-1])
+				continue
+			}
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q in JSONPath %q", v, p)
+			}
+			r = append(r, i)
+		default:
+			return nil, fmt.Errorf("unexpected %q in JSONPath %q", s[0], p)
+		}
+	}
+	return r, nil
+}
+
+// get returns the value at p in v, or nil if there isn't any.
+func (p jsonPath) get(v interface{}) interface{} {
+	for _, k := range p {
+		switch k := k.(type) {
+		case string:
+			o, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = o[k]
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || k < 0 || k >= len(a) {
+				return nil
+			}
+			v = a[k]
+		}
+	}
+	return v
+}
+
+func (p jsonPath) String() string {
+	s := "$"
+	for _, k := range p {
+		switch k := k.(type) {
+		case string:
+			s += "." + k
+		case int:
+			s += "[" + strconv.Itoa(k) + "]"
+		}
+	}
+	return s
+}
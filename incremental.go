@@ -15,12 +15,20 @@ type incrementalFormat1 struct {
 	Version    uint                        `json:"version,omitempty"`
 	Cids       map[string]*savedCidsPairs1 `json:"cids,omitempty"`
 	LastUpdate time.Time                   `json:"lastUpdate,omitempty"` // Compat with v0
+	// Filter are the include and exclude rules of the last run.
+	Filter string `json:"filter,omitempty"`
 }
 
 type savedCidsPairs1 struct {
 	Cid        string    `json:"cid"`
 	DagSize    int64     `json:"dagSize"`
 	LastUpdate time.Time `json:"lastUpdate,omitempty"`
+	// Cars are the roots of the cars holding this DAG, only known for DAGs
+	// added with -self-contained.
+	Cars []string `json:"cars,omitempty"`
+	// carSeqs are the cars of this run holding this DAG, they are moved to
+	// Cars once their roots are known.
+	carSeqs []uint64
 }
 
 func dumpIncremental(path string, data incrementalFormat) error {
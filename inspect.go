@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+
+	pb "github.com/Jorropo/linux2ipfs/pb"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"google.golang.org/protobuf/proto"
+)
+
+const inspectHelp = `Ls / inspect:
+  ` + "%[1]s" + ` ls [-blocks] <car path>...
+  Lists the directories, files and symlinks of the UnixFS DAGs in CARv1 and
+  CARv2 files with their kind, CID, file size and path from the root of
+  their DAG, then padding, fake roots and block size stats of each car.
+  Entries stored in other cars are external, raw blocks nothing links in
+  the car are either one block files or chunks of a file in an other car.
+  -blocks lists every block in car order with its offset, section length,
+    kind (fakeroot, padding, chunk, ...) and path instead of the entries.
+  inspect is an alias of ls.
+
+`
+
+// minHistogramBucket is the smallest block size bucket, as a power of 2.
+const minHistogramBucket = 8
+
+// inspectBlock is a block of the car being inspected, kind is empty until
+// something links it.
+type inspectBlock struct {
+	carBlock
+	kind string
+	path string
+}
+
+type inspectEntry struct {
+	kind string
+	cid  cid.Cid
+	// size is -1 when it has none.
+	size int64
+	path string
+}
+
+type carInspector struct {
+	data    io.ReaderAt
+	blocks  []*inspectBlock
+	byHash  map[string]*inspectBlock
+	entries []inspectEntry
+}
+
+func inspectCommand(args []string) int {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), inspectHelp, os.Args[0])
+	}
+	listBlocks := flags.Bool("blocks", false, "")
+	if flags.Parse(args) != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	var bad bool
+	for _, p := range flags.Args() {
+		err := inspectCar(os.Stdout, p, *listBlocks)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error inspecting "+p+": "+err.Error())
+			bad = bad || true
+		}
+	}
+	if bad {
+		return 1
+	}
+	return 0
+}
+
+func inspectCar(out io.Writer, path string, listBlocks bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	layout, err := readCarLayout(f, st.Size())
+	if err != nil {
+		return err
+	}
+	i := carInspector{
+		data:   io.NewSectionReader(f, layout.DataOffset, layout.DataSize),
+		byHash: map[string]*inspectBlock{},
+	}
+	header, off, err := readCarHeader(i.data)
+	if err != nil {
+		return err
+	}
+	err = readCarBlocks(i.data, off, layout.DataSize, func(b carBlock) error {
+		ib := &inspectBlock{carBlock: b}
+		i.blocks = append(i.blocks, ib)
+		if _, ok := i.byHash[string(b.Cid.Hash())]; !ok {
+			i.byHash[string(b.Cid.Hash())] = ib
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	i.walk(i.dagRoots(header.Roots))
+	for _, b := range i.blocks {
+		if first := i.byHash[string(b.Cid.Hash())]; first != b && first.kind != "" {
+			b.kind, b.path = first.kind, first.path
+		} else if b.kind == "" && isPadBlock(b.carBlock) {
+			b.kind = "padding"
+		} else if b.kind == "" {
+			b.kind = "orphan"
+		}
+	}
+
+	roots := make([]string, len(header.Roots))
+	for j, r := range header.Roots {
+		roots[j] = r.String()
+	}
+	fmt.Fprintf(out, "# %s: CARv%d, %d bytes, %d blocks, roots %s\n", path, layout.Version, st.Size(), len(i.blocks), strings.Join(roots, " "))
+	if listBlocks {
+		for _, b := range i.blocks {
+			fmt.Fprintf(out, "%d\t%d\t%s\t%s\t%s\n", b.Start, b.Offset+b.Length-b.Start, b.kind, b.Cid, b.path)
+		}
+	} else {
+		for _, e := range i.entries {
+			size := "-"
+			if e.size >= 0 {
+				size = strconv.FormatInt(e.size, 10)
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", e.kind, e.cid, size, e.path)
+		}
+	}
+	i.printStats(out, st.Size(), off)
+	return nil
+}
+
+// decode reads b as a UnixFS dag-pb node.
+func (i *carInspector) decode(b *inspectBlock) (*pb.PBNode, *pb.UnixfsData, error) {
+	data := make([]byte, b.Length)
+	_, err := i.data.ReadAt(data, b.Offset)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading block %s at %d: %w", b.Cid, b.Start, err)
+	}
+	return decodeUnixfs(data)
+}
+
+func decodeUnixfs(data []byte) (*pb.PBNode, *pb.UnixfsData, error) {
+	var n pb.PBNode
+	err := proto.Unmarshal(data, &n)
+	if err != nil {
+		return nil, nil, err
+	}
+	var u pb.UnixfsData
+	err = proto.Unmarshal(n.Data, &u)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, l := range n.Links {
+		_, err = cid.Cast(l.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return &n, &u, nil
+}
+
+// isFakeRoot reports if n looks like the nodes makeSendPayload links the
+// roots of a car with, directories of consecutive zero padded base32
+// numbers, the first link is "0" when it chains the previous fake root.
+// A real directory named like this is listed as fake roots.
+func isFakeRoot(n *pb.PBNode) bool {
+	if !bytes.Equal(n.Data, directoryData) || len(n.Links) < 2 {
+		return false
+	}
+	width := len(n.Links[len(n.Links)-1].GetName())
+	var last uint64
+	for j, l := range n.Links {
+		name := l.GetName()
+		v, err := strconv.ParseUint(name, 32, 64)
+		if err != nil || (len(name) != width && (j != 0 || name != "0")) || (j > 1 && v != last+1) {
+			return false
+		}
+		last = v
+	}
+	return true
+}
+
+// dagRoots marks the fake roots linked from the header roots and returns
+// the roots of the DAGs they link. In the reverse order the fake roots link
+// every block of the car, with dag-pb nodes under raw CIDs, so the nodes
+// decoding as UnixFS are used with their dag-pb CID and the blocks they
+// link are dropped.
+func (i *carInspector) dagRoots(headerRoots []cid.Cid) []cid.Cid {
+	var tops []cid.Cid
+	stack := make([]cid.Cid, len(headerRoots))
+	for j, r := range headerRoots {
+		stack[len(stack)-1-j] = r
+	}
+	for len(stack) != 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		b := i.byHash[string(c.Hash())]
+		if b == nil || c.Type() != cid.DagProtobuf {
+			tops = append(tops, c)
+			continue
+		}
+		n, _, err := i.decode(b)
+		if err != nil || !isFakeRoot(n) {
+			tops = append(tops, c)
+			continue
+		}
+		b.kind = "fakeroot"
+		for j := len(n.Links) - 1; j >= 0; j-- {
+			l, _ := cid.Cast(n.Links[j].Hash)
+			stack = append(stack, l)
+		}
+	}
+
+	linked := map[string]struct{}{}
+	for j, c := range tops {
+		b := i.byHash[string(c.Hash())]
+		if b == nil || b.kind != "" {
+			continue
+		}
+		n, _, err := i.decode(b)
+		if err != nil {
+			continue
+		}
+		tops[j] = cid.NewCidV1(cid.DagProtobuf, c.Hash())
+		for _, l := range n.Links {
+			lc, _ := cid.Cast(l.Hash)
+			linked[string(lc.Hash())] = struct{}{}
+		}
+	}
+	var roots []cid.Cid
+	for _, c := range tops {
+		if _, ok := linked[string(c.Hash())]; !ok {
+			roots = append(roots, c)
+		}
+	}
+	return roots
+}
+
+// walk lists the entries of the DAGs and marks the blocks they use.
+func (i *carInspector) walk(roots []cid.Cid) {
+	type item struct {
+		c    cid.Cid
+		path string
+		// chunk is set for the blocks of a file.
+		chunk bool
+		// shard is set for the HAMT shards under a directory.
+		shard bool
+		// root is set for the roots, raw roots may be chunks.
+		root bool
+	}
+	stack := make([]item, len(roots))
+	for j, r := range roots {
+		stack[len(stack)-1-j] = item{c: r, path: r.String(), root: true}
+	}
+	for len(stack) != 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if it.c.Prefix().MhType == mh.IDENTITY {
+			if !it.chunk {
+				i.entries = append(i.entries, inlineEntry(it.c, it.path, it.root))
+			}
+			continue
+		}
+		b := i.byHash[string(it.c.Hash())]
+		if b == nil {
+			if !it.chunk {
+				i.entries = append(i.entries, inspectEntry{"external", it.c, -1, it.path})
+			}
+			continue
+		}
+		mark := func(kind string) {
+			if b.kind == "" {
+				b.kind, b.path = kind, it.path
+			}
+		}
+
+		if it.c.Type() != cid.DagProtobuf {
+			switch {
+			case it.chunk:
+				mark("chunk")
+			case it.root:
+				mark("raw")
+				i.entries = append(i.entries, inspectEntry{"raw", it.c, b.Length, it.path})
+			default:
+				mark("file")
+				i.entries = append(i.entries, inspectEntry{"file", it.c, b.Length, it.path})
+			}
+			continue
+		}
+		n, u, err := i.decode(b)
+		if err != nil {
+			mark("unknown")
+			if !it.chunk {
+				i.entries = append(i.entries, inspectEntry{"unknown", it.c, -1, it.path})
+			}
+			continue
+		}
+		if it.chunk {
+			mark("chunk")
+			for j := len(n.Links) - 1; j >= 0; j-- {
+				l, _ := cid.Cast(n.Links[j].Hash)
+				stack = append(stack, item{c: l, path: it.path, chunk: true})
+			}
+			continue
+		}
+
+		kind, size := entryKind(u)
+		switch u.GetType() {
+		case pb.UnixfsData_Directory, pb.UnixfsData_HAMTShard:
+			hamt := u.GetType() == pb.UnixfsData_HAMTShard
+			for j := len(n.Links) - 1; j >= 0; j-- {
+				l, _ := cid.Cast(n.Links[j].Hash)
+				name := n.Links[j].GetName()
+				switch {
+				case !hamt:
+					stack = append(stack, item{c: l, path: it.path + "/" + name})
+				case len(name) == 2:
+					// An other level of the same directory.
+					stack = append(stack, item{c: l, path: it.path, shard: true})
+				default:
+					stack = append(stack, item{c: l, path: it.path + "/" + name[2:]})
+				}
+			}
+		case pb.UnixfsData_File:
+			for j := len(n.Links) - 1; j >= 0; j-- {
+				l, _ := cid.Cast(n.Links[j].Hash)
+				stack = append(stack, item{c: l, path: it.path, chunk: true})
+			}
+		}
+		mark(kind)
+		if !it.shard {
+			i.entries = append(i.entries, inspectEntry{kind, it.c, size, it.path})
+		}
+	}
+}
+
+func (i *carInspector) printStats(out io.Writer, size, headerLen int64) {
+	counts := map[string]int{}
+	lengths := map[string]int64{}
+	var histogram []int
+	for _, b := range i.blocks {
+		counts[b.kind]++
+		lengths[b.kind] += b.Offset + b.Length - b.Start
+		if b.kind == "padding" {
+			continue
+		}
+		bucket := minHistogramBucket
+		if b.Length > 1 {
+			if l := bits.Len64(uint64(b.Length - 1)); l > bucket {
+				bucket = l
+			}
+		}
+		for len(histogram) <= bucket {
+			histogram = append(histogram, 0)
+		}
+		histogram[bucket]++
+	}
+	entries := map[string]int{}
+	for _, e := range i.entries {
+		entries[e.kind]++
+	}
+
+	fmt.Fprintf(out, "# header: %d bytes\n", headerLen)
+	fmt.Fprintf(out, "# padding: %d blocks, %d bytes (%.2f%% of the car)\n", counts["padding"], lengths["padding"], float64(lengths["padding"])*100/float64(size))
+	fmt.Fprintf(out, "# fake roots: %d blocks, %d bytes\n", counts["fakeroot"], lengths["fakeroot"])
+	fmt.Fprintf(out, "# entries: %d dirs, %d files, %d symlinks, %d raw, %d external\n", entries["dir"], entries["file"], entries["symlink"], entries["raw"], entries["external"])
+	if counts["orphan"] != 0 || counts["unknown"] != 0 {
+		fmt.Fprintf(out, "# orphaned: %d blocks, unknown: %d blocks\n", counts["orphan"], counts["unknown"])
+	}
+	fmt.Fprintf(out, "# block sizes (padding excluded):\n")
+	for bucket, n := range histogram {
+		if n != 0 {
+			fmt.Fprintf(out, "#   <= %s: %d\n", formatPow2Size(bucket), n)
+		}
+	}
+}
+
+// inlineEntry returns the entry of an inlined block, inlined directories
+// are listed but not walked.
+func inlineEntry(c cid.Cid, path string, root bool) inspectEntry {
+	e := inspectEntry{"unknown", c, -1, path}
+	d, err := mh.Decode(c.Hash())
+	if err != nil {
+		return e
+	}
+	if c.Type() != cid.DagProtobuf {
+		e.kind, e.size = "file", int64(len(d.Digest))
+		if root {
+			e.kind = "raw"
+		}
+		return e
+	}
+	_, u, err := decodeUnixfs(d.Digest)
+	if err != nil {
+		return e
+	}
+	e.kind, e.size = entryKind(u)
+	return e
+}
+
+// entryKind returns the kind and size of a UnixFS node, size is -1 for
+// directories.
+func entryKind(u *pb.UnixfsData) (string, int64) {
+	switch u.GetType() {
+	case pb.UnixfsData_Directory, pb.UnixfsData_HAMTShard:
+		return "dir", -1
+	case pb.UnixfsData_File:
+		return "file", int64(u.GetFilesize())
+	case pb.UnixfsData_Symlink:
+		return "symlink", int64(len(u.Data))
+	default:
+		return strings.ToLower(u.GetType().String()), -1
+	}
+}
+
+// formatPow2Size formats 1<<exp bytes with an IEC unit.
+func formatPow2Size(exp int) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	u := exp / 10
+	if u >= len(units) {
+		u = len(units) - 1
+	}
+	return strconv.FormatUint(1<<uint(exp-u*10), 10) + units[u]
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultKuboAPI = "/ip4/127.0.0.1/tcp/5001"
+
+var kuboDriverCreator = driverCreator{
+	factory:    newKuboDriver,
+	help:       kuboHelp,
+	maxCarSize: 1 << 42, // dag/import is streamed, so only the temp file limits the size
+}
+
+func kuboHelp(out io.Writer) {
+	fmt.Fprint(out, `  Positional:
+  - <API> defaults to "`+defaultKuboAPI+`", the kubo RPC API address as a multiaddr
+    (/ip4/.../tcp/..., /dns/.../tcp/..., /unix/...) or an url (http://..., unix:///...)
+  Options:
+  - pin=<bool> pin the root of each car, defaults to true
+
+`)
+}
+
+func newKuboDriver(input string) (driver, error) {
+	api, opts, err := parseDriverParams(input)
+	if err != nil {
+		return nil, err
+	}
+	if api == "" {
+		api = defaultKuboAPI
+	}
+	pin, err := opts.takeBool("pin", true)
+	if err != nil {
+		return nil, err
+	}
+	err = opts.done()
+	if err != nil {
+		return nil, err
+	}
+
+	base, client, err := newKuboClient(api)
+	if err != nil {
+		return nil, err
+	}
+	return &kuboDriver{
+		base:   base,
+		pin:    pin,
+		client: client,
+	}, nil
+}
+
+// newKuboClient returns the base url and a client able to talk to a kubo
+// RPC API given as a multiaddr or an url.
+func newKuboClient(api string) (string, *http.Client, error) {
+	var unixPath string
+	base := api
+	switch {
+	case strings.HasPrefix(api, "/"):
+		parts := strings.Split(api[1:], "/")
+		if len(parts) < 2 {
+			return "", nil, fmt.Errorf("invalid multiaddr %q", api)
+		}
+		switch parts[0] {
+		case "unix":
+			unixPath = "/" + strings.Join(parts[1:], "/")
+		case "ip4", "ip6", "dns", "dns4", "dns6":
+			if len(parts) < 4 || parts[2] != "tcp" {
+				return "", nil, fmt.Errorf("only tcp multiaddrs are supported, got %q", api)
+			}
+			host := net.JoinHostPort(parts[1], parts[3])
+			scheme := "http"
+			if len(parts) > 4 {
+				switch parts[4] {
+				case "http":
+				case "https", "tls":
+					scheme = "https"
+				default:
+					return "", nil, fmt.Errorf("unsupported multiaddr protocol %q in %q", parts[4], api)
+				}
+			}
+			base = scheme + "://" + host
+		default:
+			return "", nil, fmt.Errorf("unsupported multiaddr protocol %q in %q", parts[0], api)
+		}
+	case strings.HasPrefix(api, "unix:"):
+		unixPath = strings.TrimPrefix(strings.TrimPrefix(api, "unix:"), "//")
+	case strings.HasPrefix(api, "http://"), strings.HasPrefix(api, "https://"):
+		base = strings.TrimSuffix(api, "/")
+	default:
+		return "", nil, fmt.Errorf("unsupported API address %q", api)
+	}
+
+	if unixPath == "" {
+		return base, newHTTPClient(), nil
+	}
+	var d net.Dialer
+	t := baseTransport().Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, "unix", unixPath)
+	}
+	return "http://unix", &http.Client{Transport: t}, nil
+}
+
+type kuboDriver struct {
+	base string
+	pin  bool
+
+	client *http.Client
+}
+
+// rpc calls a kubo RPC API command which doesn't take a body and decodes its
+// JSON result in out if it isn't nil.
+func (k *kuboDriver) rpc(ctx context.Context, command string, args url.Values, out interface{}) error {
+	endpoint := k.base + "/api/v0/" + command
+	if len(args) != 0 {
+		endpoint += "?" + args.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("creating the request failed: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting %s failed: %w", command, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s non 200 result code: %d / body: %s", command, resp.StatusCode, string(b))
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("decoding %s result: %w", command, err)
+	}
+	return nil
+}
+
+func (k *kuboDriver) Send(ctx context.Context, payload CarPayload) (Receipt, error) {
+	// Build the multipart envelope around the car ourself so the car can be
+	// streamed with a known length.
+	var envelope bytes.Buffer
+	mw := multipart.NewWriter(&envelope)
+	_, err := mw.CreateFormFile("file", "car")
+	if err != nil {
+		return Receipt{}, fmt.Errorf("creating multipart header: %w", err)
+	}
+	headerLen := envelope.Len()
+	err = mw.Close()
+	if err != nil {
+		return Receipt{}, fmt.Errorf("creating multipart trailer: %w", err)
+	}
+	header, trailer := envelope.Bytes()[:headerLen], envelope.Bytes()[headerLen:]
+
+	endpoint := k.base + "/api/v0/dag/import?pin-roots=" + strconv.FormatBool(k.pin)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, io.MultiReader(bytes.NewReader(header), payload.Reader(ctx), bytes.NewReader(trailer)))
+	if err != nil {
+		return Receipt{}, fmt.Errorf("creating the request failed: %w", err)
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.ContentLength = int64(len(header)) + payload.Size + int64(len(trailer))
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("posting failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return Receipt{}, fmt.Errorf("non 200 result code: %d / body: %s", resp.StatusCode, string(b))
+	}
+
+	var pinned string
+	d := json.NewDecoder(resp.Body)
+	for {
+		var res struct {
+			Root *struct {
+				Cid struct {
+					Slash string `json:"/"`
+				}
+				PinErrorMsg string
+			}
+			Message string
+			Type    string
+		}
+		err = d.Decode(&res)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Receipt{}, fmt.Errorf("decoding import result: %w", err)
+		}
+		if res.Type == "error" {
+			return Receipt{}, fmt.Errorf("importing: %s", res.Message)
+		}
+		if res.Root == nil {
+			continue
+		}
+		if res.Root.PinErrorMsg != "" {
+			return Receipt{}, fmt.Errorf("pinning %s: %s", res.Root.Cid.Slash, res.Root.PinErrorMsg)
+		}
+		err = checkReturnedCid(res.Root.Cid.Slash, payload.Root)
+		if err != nil {
+			return Receipt{}, err
+		}
+		pinned = res.Root.Cid.Slash
+	}
+	// Errors happening once the response started are sent as a trailer.
+	if e := resp.Trailer.Get("X-Stream-Error"); e != "" {
+		return Receipt{}, fmt.Errorf("importing: %s", e)
+	}
+	if k.pin && pinned == "" {
+		return Receipt{}, fmt.Errorf("kubo didn't report pinning the root")
+	}
+
+	info := map[string]string{}
+	if pinned != "" {
+		info["pinned"] = pinned
+	}
+	return Receipt{Info: info}, nil
+}
+
+func (*kuboDriver) Close() error {
+	return nil
+}
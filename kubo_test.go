@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// newTestPayload returns a payload whose header and body are stored like the
+// pipeline does, the body in a temp file at a non zero offset.
+func newTestPayload(t *testing.T, header, body []byte) CarPayload {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	const offset = 4096
+	_, err = f.WriteAt(body, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(append(append([]byte{}, header...), body...))
+	hash, err := mh.Encode(h[:], mh.SHA2_256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CarPayload{
+		Root:      cid.NewCidV1(cid.DagProtobuf, hash),
+		Size:      int64(len(header) + len(body)),
+		Header:    header,
+		Car:       f,
+		CarOffset: offset,
+	}
+}
+
+// fakeKubo serves dag/import, checking the car sent matches want and
+// answering with root as the imported root and streamErr as the
+// X-Stream-Error trailer.
+func fakeKubo(t *testing.T, want []byte, root, streamErr string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/dag/import" {
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("pin-roots") != "true" {
+			http.Error(w, "missing pin-roots", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		got, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("kubo received %d bytes, expected %d", len(got), len(want))
+		}
+
+		w.Header().Set("Trailer", "X-Stream-Error")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"Root":{"Cid":{"/":%q},"PinErrorMsg":""}}`+"\n", root)
+		if streamErr != "" {
+			w.Header().Set("X-Stream-Error", streamErr)
+		}
+	})
+}
+
+func TestKuboSend(t *testing.T) {
+	header, body := []byte("header"), bytes.Repeat([]byte("car body "), 1000)
+	payload := newTestPayload(t, header, body)
+	want := append(append([]byte{}, header...), body...)
+
+	for _, tc := range []struct {
+		name      string
+		root      string
+		streamErr string
+		err       string
+	}{
+		{name: "success", root: payload.Root.String()},
+		{name: "root mismatch", root: newTestPayload(t, nil, []byte("other")).Root.String(), err: "doesn't match car root"},
+		{name: "stream error", root: payload.Root.String(), streamErr: "blockstore full", err: "importing: blockstore full"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(fakeKubo(t, want, tc.root, tc.streamErr))
+			defer srv.Close()
+
+			d, err := newKuboDriver(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receipt, err := d.Send(context.Background(), payload)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if receipt.Info["pinned"] != payload.Root.String() {
+				t.Errorf("expected pinned %s, got %q", payload.Root, receipt.Info["pinned"])
+			}
+		})
+	}
+}
+
+func TestKuboUnixSocket(t *testing.T) {
+	payload := newTestPayload(t, []byte("header"), []byte("body"))
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(fakeKubo(t, []byte("headerbody"), payload.Root.String(), ""))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	for _, api := range []string{"/unix" + sock, "unix://" + sock} {
+		d, err := newKuboDriver(api)
+		if err != nil {
+			t.Fatalf("%s: %v", api, err)
+		}
+		_, err = d.Send(context.Background(), payload)
+		if err != nil {
+			t.Errorf("%s: %v", api, err)
+		}
+	}
+}
+
+func TestNewKuboClient(t *testing.T) {
+	for _, tc := range []struct {
+		api  string
+		base string
+		err  bool
+	}{
+		{api: "/ip4/127.0.0.1/tcp/5001", base: "http://127.0.0.1:5001"},
+		{api: "/ip6/::1/tcp/5001", base: "http://[::1]:5001"},
+		{api: "/dns/kubo.example/tcp/443/https", base: "https://kubo.example:443"},
+		{api: "/dns4/kubo.example/tcp/5001/http", base: "http://kubo.example:5001"},
+		{api: "/unix/run/kubo.sock", base: "http://unix"},
+		{api: "unix:///run/kubo.sock", base: "http://unix"},
+		{api: "http://127.0.0.1:5001/", base: "http://127.0.0.1:5001"},
+		{api: "/ip4/127.0.0.1/udp/5001", err: true},
+		{api: "/ip4/127.0.0.1/tcp/5001/ws", err: true},
+		{api: "/p2p/12D3KooW", err: true},
+		{api: "/ip4", err: true},
+		{api: "localhost:5001", err: true},
+	} {
+		base, _, err := newKuboClient(tc.api)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got base %q", tc.api, base)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.api, err)
+			continue
+		}
+		if base != tc.base {
+			t.Errorf("%s: expected base %q, got %q", tc.api, tc.base, base)
+		}
+	}
+}
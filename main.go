@@ -1,18 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -32,8 +36,10 @@ const (
 	defaultInlineLimit     = 128
 	tempFileNamePattern    = ".temp.%s.car"
 	defaultIncrementalFile = "old.json"
+	receiptsFileSuffix     = ".receipts"
 	defaultUploadTries     = 3
 	defaultUploadFailedOut = "failed"
+	defaultInflightCars    = 2
 	diskAssumedBlockSize   = 4096
 	doJobsBuffer           = 1024 * 16
 
@@ -66,14 +72,27 @@ func init() {
 func init() {
 	flag.Usage = func() {
 		o := flag.CommandLine.Output()
-		fmt.Fprint(o, "Usage for: "+os.Args[0]+" <target file path>\n\n")
+		fmt.Fprint(o, "Usage for: "+os.Args[0]+" <target file path>\n")
+		fmt.Fprint(o, "       or: "+os.Args[0]+" config check [flags] [<target file path>]\n")
+		fmt.Fprint(o, "       or: "+os.Args[0]+" verify [-missing-ok] <car path>...\n")
+		fmt.Fprint(o, "       or: "+os.Args[0]+" ls [-blocks] <car path>...\n")
+		fmt.Fprint(o, "       or: "+os.Args[0]+" extract <root CID> <output path> <car path>...\n")
+		fmt.Fprint(o, "       or: "+os.Args[0]+" repack [flags] <car path>...\n\n")
 		fmt.Fprint(o, "Drivers:\n")
 		for n, d := range drivers {
 			fmt.Fprint(o, "- "+n+":\n")
 			d.help(o)
 		}
+		fmt.Fprint(o, secretsHelp)
+		fmt.Fprint(o, configHelp)
+		fmt.Fprintf(o, verifyHelp, os.Args[0])
+		fmt.Fprintf(o, inspectHelp, os.Args[0])
+		fmt.Fprintf(o, extractHelp, os.Args[0])
+		fmt.Fprintf(o, repackHelp, os.Args[0])
 		fmt.Fprint(o, `Positional:
-  <target file path> REQUIRED
+  <target file path> REQUIRED unless set by the config, a target named like a
+  command (config, verify, ls, inspect, extract, repack) must be written ./name
+  or come after -- or a flag, else the command is run
 
 Flags:
 `)
@@ -82,7 +101,23 @@ Flags:
 	}
 }
 
+// commands are selected by the first argument, without one a run is done,
+// "--" or "./" before a target named like a command runs on it.
+var commands = map[string]func(args []string) int{
+	"config":  configCommand,
+	"verify":  verifyCommand,
+	"ls":      inspectCommand,
+	"inspect": inspectCommand,
+	"extract": extractCommand,
+	"repack":  repackCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if c, ok := commands[os.Args[1]]; ok {
+			os.Exit(c(os.Args[2:]))
+		}
+	}
 	os.Exit(mainRet())
 }
 
@@ -93,144 +128,380 @@ var uploadTries uint
 var uploadFailedOut string
 var noPad bool
 
-func mainRet() int {
-	var incrementalFile string
-	var target string
-	var concurrentChunkers int64
-	var driverToUse driver
-	var dumpThrottle time.Duration
-	{
-		var driverTarget string
-		flag.Int64Var(&blockTarget, "block-target", defaultBlockTarget, "Maximum size of blocks.")
-		flag.Int64Var(&carMaxSize, "car-size", 0, "Car reset point, this is mostly how big you want your CARs to be, but it actually is at which point does it stop adding more blocks to it, there is often a 1~128MiB more data to sent (the fakeroots and the header), 0 defaults to the driver default.")
-		flag.Int64Var(&inlineLimit, "inline-limit", defaultInlineLimit, "The maximum size at which to attempt to inline blocks.")
-		flag.StringVar(&incrementalFile, "incremental-file", defaultIncrementalFile, "Path to the file which stores the old CIDs and old update time.")
-		flag.Int64Var(&concurrentChunkers, "concurrent-chunkers", 0, "Number of chunkers to concurrently run, 0 == Num CPUs (note, this only works intra file, the discovery loop is still single threaded).")
-		flag.UintVar(&uploadTries, "max-upload-attempt", defaultUploadTries, "Number of time to try to upload the resulting cars.")
-		flag.StringVar(&uploadFailedOut, "failed-outs", defaultUploadFailedOut, "Where to move failed upload car files in case an upload failed too many times.")
-		flag.BoolVar(&noPad, "no-pad", false, "Doesn't pad the data chunks in the output car to "+strconv.FormatUint(diskAssumedBlockSize, 10)+" bytes, make marginally smaller output cars however likely NOT produce reflinked data.")
-		flag.StringVar(&driverTarget, "driver", "", "Driver selector.")
-		flag.DurationVar(&dumpThrottle, "dump-throttle", time.Minute*5, "Throttle how often incremental file can be dumped (it will always force dump once finished).")
-		flag.Parse()
-
-		bad := false
-
-		driversAndOptions := strings.SplitN(driverTarget, "-", 2)
-		if len(driversAndOptions) == 1 {
-			driversAndOptions = append(driversAndOptions, "")
-		}
-
-		if blockTarget < 1024 {
-			fmt.Fprintln(os.Stderr, "error block-target should be at least 1024 bytes")
+// runOptions are the validated settings of a run.
+type runOptions struct {
+	incrementalFile    string
+	target             string
+	concurrentChunkers int64
+	drivers            []*namedDriver
+	replication        replicationPolicy
+	routes             []route
+	sectorFit          int64
+	selfContained      bool
+	dumpThrottle       time.Duration
+	inflightCars       int64
+	uploadWindows      []uploadWindow
+	filter             pathFilter
+	// cars are the car paths given to repack instead of the target.
+	cars []string
+}
+
+// parseRunOptions parses and validates the flags, envs and config file,
+// problems are printed and false is returned if any were found. With repack
+// the positionals are the cars to repack.
+func parseRunOptions(args []string, repack bool) (runOptions, bool) {
+	var o runOptions
+	var driverTargets stringList
+	var routeTargets stringList
+	var replicationTarget string
+	var bandwidthLimit string
+	var fitSector string
+	var uploadWindowTargets stringList
+	var httpOptions httpClientOptions
+	var includes, excludes stringList
+	var configPath, profile string
+	flag.Int64Var(&blockTarget, "block-target", defaultBlockTarget, "Maximum size of blocks.")
+	flag.Int64Var(&carMaxSize, "car-size", 0, "Car reset point, this is mostly how big you want your CARs to be, but it actually is at which point does it stop adding more blocks to it, there is often a 1~128MiB more data to sent (the fakeroots and the header), 0 defaults to the driver default.")
+	flag.StringVar(&fitSector, "fit-sector", "", "Size cars so once fr32 padded they fit a Filecoin sector of this size (like 32GiB or 64GiB), counting the header, fakeroots and drivers padding and CARv2 index, exclusive with car-size.")
+	flag.BoolVar(&o.selfContained, "self-contained", false, "Make the roots of each car complete DAGs: cars only link DAGs whose descendants are in the same car or in earlier cars listed in the manifest and files are moved to a new car instead of being split when they fit one, cars of DAGs added by runs without this flag are not known.")
+	flag.Int64Var(&inlineLimit, "inline-limit", defaultInlineLimit, "The maximum size at which to attempt to inline blocks.")
+	flag.StringVar(&o.incrementalFile, "incremental-file", defaultIncrementalFile, "Path to the file which stores the old CIDs and old update time.")
+	flag.Int64Var(&o.concurrentChunkers, "concurrent-chunkers", 0, "Number of chunkers to concurrently run, 0 == Num CPUs (note, this only works intra file, the discovery loop is still single threaded).")
+	flag.UintVar(&uploadTries, "max-upload-attempt", defaultUploadTries, "Number of time to try to upload the resulting cars.")
+	flag.StringVar(&uploadFailedOut, "failed-outs", defaultUploadFailedOut, "Where to move failed upload car files in case an upload failed too many times.")
+	flag.BoolVar(&noPad, "no-pad", false, "Doesn't pad the data chunks in the output car to "+strconv.FormatUint(diskAssumedBlockSize, 10)+" bytes, make marginally smaller output cars however likely NOT produce reflinked data.")
+	flag.Var(&driverTargets, "driver", "Driver selector, <name>[-<params>] where params usually are an optional positional followed by comma separated key=value options (a comma in a value is escaped as \\,), can be repeated to send cars to multiple drivers.")
+	flag.Var(&routeTargets, "route", "Size based routing, <size>:<driver> sends cars up to size (like 100MiB) to driver, the first matching route wins and a last <driver> route catches bigger cars, can be repeated, each car is sized for the first route fitting the file being written when it is started, exclusive with -driver and -replication.")
+	flag.StringVar(&replicationTarget, "replication", "all", "When using multiple drivers, \"all\" of them must succeed, at least \"<N>\" of them must succeed or \"fallback\" to try them in order until one succeeds.")
+	flag.DurationVar(&o.dumpThrottle, "dump-throttle", time.Minute*5, "Throttle how often incremental file can be dumped (it will always force dump once finished).")
+	flag.Int64Var(&o.inflightCars, "inflight-cars", defaultInflightCars, "Number of temp car buffers, one is being chunked into while the others are uploaded by inflight-cars - 1 concurrent senders, disk usage is bounded to about inflight-cars * car-size.")
+	flag.StringVar(&bandwidthLimit, "bandwidth-limit", "", "Maximum speed at which drivers upload cars in bytes per second (like 10MiB), shared by all uploads, empty is unlimited.")
+	flag.Var(&uploadWindowTargets, "upload-window", "Local time of day range in which new uploads can start, HH:MM-HH:MM, can be repeated, chunking continues in free inflight-cars while waiting, defaults to always.")
+	flag.StringVar(&httpOptions.proxy, "http-proxy", "", "Proxy url used by HTTP based drivers, \"none\" disables proxies, defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY envs.")
+	flag.StringVar(&httpOptions.ca, "http-ca", "", "PEM bundle of the only CAs HTTP based drivers trust, defaults to the system's.")
+	flag.StringVar(&httpOptions.cert, "http-cert", "", "PEM client certificate HTTP based drivers authenticate with, requires http-key.")
+	flag.StringVar(&httpOptions.key, "http-key", "", "PEM key of http-cert.")
+	flag.DurationVar(&httpOptions.dialTimeout, "http-dial-timeout", 30*time.Second, "Timeout to establish connections of HTTP based drivers, 0 is none.")
+	flag.DurationVar(&httpOptions.tlsTimeout, "http-tls-timeout", 10*time.Second, "Timeout of TLS handshakes of HTTP based drivers, 0 is none.")
+	flag.DurationVar(&httpOptions.idleTimeout, "http-idle-timeout", 90*time.Second, "How long HTTP based drivers keep idle connections, 0 is forever.")
+	flag.BoolVar(&httpOptions.http2, "http2", true, "Allow HTTP based drivers to use HTTP/2.")
+	flag.Var(&includes, "include", "Only add files matching this glob, patterns with a / match the path relative to the target and others the name, directories are always walked, can be repeated.")
+	flag.Var(&excludes, "exclude", "Skip files and directories matching this glob, matched like include, can be repeated.")
+	flag.StringVar(&configPath, "config", "", "JSON config file setting flags not given on the command line or by envs.")
+	flag.StringVar(&profile, "profile", "", "Profile of the config file to use.")
+	flag.CommandLine.Parse(args)
+
+	bad := false
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	err := applyFlagEnvs(flag.CommandLine, set)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error env: "+err.Error())
+		bad = bad || true
+	}
+	var configTarget string
+	if configPath != "" {
+		configTarget, err = applyConfigFile(flag.CommandLine, configPath, profile, set)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error config: "+err.Error())
 			bad = bad || true
 		}
-		if blockTarget > 1024*1024*2 {
-			fmt.Fprintln(os.Stderr, "error block-target cannot be bigger than 2MiB")
-			bad = bad || true
+	} else if profile != "" {
+		fmt.Fprintln(os.Stderr, "error profile requires config")
+		bad = bad || true
+	}
+
+	if blockTarget < 1024 {
+		fmt.Fprintln(os.Stderr, "error block-target should be at least 1024 bytes")
+		bad = bad || true
+	}
+	if blockTarget > 1024*1024*2 {
+		fmt.Fprintln(os.Stderr, "error block-target cannot be bigger than 2MiB")
+		bad = bad || true
+	}
+
+	httpTransport, err = httpOptions.transport()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error http: "+err.Error())
+		bad = bad || true
+	}
+
+	if len(driverTargets) != 0 && len(routeTargets) != 0 {
+		fmt.Fprintln(os.Stderr, "error driver and route cannot be used together")
+		bad = bad || true
+	} else if len(driverTargets) == 0 && len(routeTargets) == 0 {
+		fmt.Fprintf(os.Stderr, "error no driver specified, you can see potential drivers with: %q\n\tExample: \n\t\t%s\n", os.Args[0]+" -help", os.Args[0]+" -driver car "+strings.Join(args, " "))
+		bad = bad || true
+	} else {
+		var maxCarSize int64 = math.MaxInt64
+		for _, driverTarget := range driverTargets {
+			d, driverMaxCarSize, err := newNamedDriver(driverTarget)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error "+redact(err.Error()))
+				bad = bad || true
+				continue
+			}
+			if driverMaxCarSize < maxCarSize {
+				maxCarSize = driverMaxCarSize
+			}
+			o.drivers = append(o.drivers, d)
 		}
 
-		if driverTarget == "" {
-			fmt.Fprintf(os.Stderr, "error no driver specified, you can see potential drivers with: %q\n\tExample: \n\t\t%s\n", os.Args[0]+" -help", os.Args[0]+" -driver car "+strings.Join(os.Args[1:], " "))
-			bad = bad || true
-		} else {
-			var ok bool
-			driv, ok := drivers[driversAndOptions[0]]
-			if !ok {
-				fmt.Fprintf(os.Stderr, "error driver: %q not found\n", driverTarget)
+		if len(routeTargets) != 0 {
+			// Temp cars are sized for the biggest route, each car is then
+			// limited to the route picked when it is started.
+			if set["replication"] {
+				fmt.Fprintln(os.Stderr, "error replication cannot be used with route, each car is sent to a single route")
 				bad = bad || true
-			} else {
-				var err error
-				driverToUse, err = driv.factory(driversAndOptions[1])
+			}
+			maxCarSize = 0
+			for i, routeTarget := range routeTargets {
+				size, driverTarget, err := parseRoute(routeTarget)
 				if err != nil {
-					fmt.Fprintln(os.Stderr, "error creating driver: "+err.Error())
+					fmt.Fprintln(os.Stderr, "error route: "+err.Error())
 					bad = bad || true
+					continue
 				}
+				if size == 0 && i != len(routeTargets)-1 {
+					fmt.Fprintf(os.Stderr, "error route: %q catches all cars and must be the last one\n", routeTarget)
+					bad = bad || true
+				}
+				d, driverMaxCarSize, err := newNamedDriver(driverTarget)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "error "+redact(err.Error()))
+					bad = bad || true
+					continue
+				}
+				if size == 0 || size > driverMaxCarSize {
+					size = driverMaxCarSize
+				}
+				if size > maxCarSize {
+					maxCarSize = size
+				}
+				o.drivers = append(o.drivers, d)
+				o.routes = append(o.routes, route{maxSize: size, d: d})
 			}
-
-			if carMaxSize == 0 {
-				carMaxSize = driv.maxCarSize
-			} else if carMaxSize > driv.maxCarSize {
-				fmt.Fprintln(os.Stderr, "error car-size cannot be bigger than driver's maximum")
-				bad = bad || true
+			if maxCarSize == 0 {
+				// All routes failed and were reported already.
+				maxCarSize = math.MaxInt64
 			}
-			if carMaxSize < blockTarget {
-				fmt.Fprintln(os.Stderr, "error car-size cannot be smaller than block-target")
+		} else {
+			var err error
+			o.replication, err = parseReplicationPolicy(replicationTarget, len(driverTargets))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error replication: "+err.Error())
 				bad = bad || true
 			}
-			if !noPad {
-				if carMaxSize < diskAssumedBlockSize*2 {
-					fmt.Fprintln(os.Stderr, "error car-size cannot be smaller than "+strconv.Itoa(diskAssumedBlockSize*2)+" when padding is enabled")
-					bad = bad || true
-				}
-				if blockTarget > (carMaxSize - diskAssumedBlockSize) {
-					fmt.Fprintln(os.Stderr, "error car-size + block-target cannot be bigger than car-size - "+strconv.Itoa(diskAssumedBlockSize)+" when padding is enabled")
-					bad = bad || true
+		}
+
+		if fitSector != "" {
+			fit, err := parseSectorSize(fitSector)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error fit-sector: "+err.Error())
+				bad = bad || true
+			} else if carMaxSize != 0 {
+				fmt.Fprintln(os.Stderr, "error fit-sector and car-size cannot be used together")
+				bad = bad || true
+			} else {
+				o.sectorFit = fit
+				if limit := fit - sectorReserve; limit < maxCarSize {
+					maxCarSize = limit
 				}
 			}
 		}
-		if inlineLimit < 0 {
-			fmt.Fprintln(os.Stderr, "error inline-limit cannot be negative")
+		if carMaxSize == 0 {
+			carMaxSize = maxCarSize
+		} else if carMaxSize > maxCarSize {
+			fmt.Fprintln(os.Stderr, "error car-size cannot be bigger than driver's maximum")
 			bad = bad || true
 		}
-		if incrementalFile == "" {
-			fmt.Fprintln(os.Stderr, "error empty incremental-file")
+		if carMaxSize < blockTarget {
+			fmt.Fprintln(os.Stderr, "error car-size cannot be smaller than block-target")
 			bad = bad || true
 		}
-		if concurrentChunkers == 0 {
-			concurrentChunkers = int64(runtime.NumCPU())
+		if !noPad {
+			if carMaxSize < diskAssumedBlockSize*2 {
+				fmt.Fprintln(os.Stderr, "error car-size cannot be smaller than "+strconv.Itoa(diskAssumedBlockSize*2)+" when padding is enabled")
+				bad = bad || true
+			}
+			if blockTarget > (carMaxSize - diskAssumedBlockSize) {
+				fmt.Fprintln(os.Stderr, "error car-size + block-target cannot be bigger than car-size - "+strconv.Itoa(diskAssumedBlockSize)+" when padding is enabled")
+				bad = bad || true
+			}
+		}
+	}
+	if inlineLimit < 0 {
+		fmt.Fprintln(os.Stderr, "error inline-limit cannot be negative")
+		bad = bad || true
+	}
+	if o.incrementalFile == "" {
+		fmt.Fprintln(os.Stderr, "error empty incremental-file")
+		bad = bad || true
+	}
+	if o.concurrentChunkers == 0 {
+		o.concurrentChunkers = int64(runtime.NumCPU())
+	}
+	if o.concurrentChunkers < 0 {
+		fmt.Fprintln(os.Stderr, "error negative concurrent chunkers")
+		bad = bad || true
+	}
+	if uploadTries == 0 {
+		fmt.Fprintln(os.Stderr, "error zero max-upload-attempt")
+		bad = bad || true
+	}
+	if o.inflightCars < 2 {
+		fmt.Fprintln(os.Stderr, "error inflight-cars must be at least 2")
+		bad = bad || true
+	}
+	if bandwidthLimit != "" {
+		rate, err := parseSize(bandwidthLimit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error bandwidth-limit: "+err.Error())
+			bad = bad || true
+		} else if rate != 0 {
+			uploadLimiter = newRateLimiter(rate)
 		}
-		if concurrentChunkers < 0 {
-			fmt.Fprintln(os.Stderr, "error negative concurrent chunkers")
+	}
+	for _, w := range uploadWindowTargets {
+		window, err := parseUploadWindow(w)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error upload-window: "+err.Error())
 			bad = bad || true
+			continue
 		}
-		if uploadTries == 0 {
-			fmt.Fprintln(os.Stderr, "error zero max-upload-attempt")
+		o.uploadWindows = append(o.uploadWindows, window)
+	}
+	if uploadFailedOut == "" {
+		fmt.Fprintln(os.Stderr, "error empty failed-outs")
+		bad = bad || true
+	} else if l := len(uploadFailedOut) - 1; uploadFailedOut[l] == '/' {
+		uploadFailedOut = uploadFailedOut[:l]
+	}
+
+	o.filter, err = newPathFilter(includes, excludes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error filter: "+err.Error())
+		bad = bad || true
+	}
+
+	if repack {
+		o.cars = flag.Args()
+		if len(o.cars) == 0 {
+			fmt.Fprintln(os.Stderr, "error expected positional <car path>...")
 			bad = bad || true
 		}
-		if uploadFailedOut == "" {
-			fmt.Fprintln(os.Stderr, "error empty failed-outs")
+		if o.selfContained {
+			fmt.Fprintln(os.Stderr, "error self-contained cannot be used with repack")
 			bad = bad || true
-		} else if l := len(uploadFailedOut) - 1; uploadFailedOut[l] == '/' {
-			uploadFailedOut = uploadFailedOut[:l]
 		}
-
-		if args := flag.Args(); len(args) != 1 {
-			fmt.Fprintln(os.Stderr, "error expected one positional <target file path>")
+		if len(includes) != 0 || len(excludes) != 0 {
+			fmt.Fprintln(os.Stderr, "error include and exclude cannot be used with repack")
 			bad = bad || true
-		} else {
-			target = args[0]
-			if len(target) != 0 {
-				l := len(target) - 1
-				if target[l] == '/' {
-					target = target[:l]
-				}
+		}
+	} else if args := flag.Args(); len(args) > 1 || len(args) == 0 && configTarget == "" {
+		fmt.Fprintln(os.Stderr, "error expected one positional <target file path>")
+		bad = bad || true
+	} else {
+		o.target = configTarget
+		if len(args) == 1 {
+			o.target = args[0]
+		}
+		if len(o.target) != 0 {
+			l := len(o.target) - 1
+			if o.target[l] == '/' {
+				o.target = o.target[:l]
 			}
 		}
+	}
 
-		if bad {
-			return 1
-		}
+	if bad {
+		return runOptions{}, false
 	}
 
-	tempFileName := fmt.Sprintf(tempFileNamePattern, "A")
-	tempCarA, err := os.OpenFile(tempFileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "error openning tempCar: "+err.Error())
+	nameDrivers(o.drivers)
+	return o, true
+}
+
+func mainRet() int {
+	o, ok := parseRunOptions(os.Args[1:], false)
+	if !ok {
 		return 1
 	}
-	defer os.Remove(tempFileName)
-	defer tempCarA.Close()
 
-	tempFileName = fmt.Sprintf(tempFileNamePattern, "B")
-	tempCarB, err := os.OpenFile(tempFileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "error openning tempCar: "+err.Error())
-		return 1
+	return runPipeline(o, true, func(r *recursiveTraverser) int {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.statWorker(o.target)
+		}()
+		defer wg.Wait()
+
+		var err error
+		r.olds, err = loadIncremental(o.incrementalFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error loading incremental file: "+err.Error())
+			return 1
+		}
+		if filter := o.filter.String(); r.olds.Filter != filter {
+			// Directories may be unchanged but have different entries now.
+			r.filterChanged = true
+			r.olds.Filter = filter
+		}
+
+		c, updated, err := r.do()
+		if err != nil {
+			if !errors.Is(err, errClosing) {
+				fmt.Fprintln(os.Stderr, "error doing: "+err.Error())
+			}
+			return 1
+		}
+		err = r.flush()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error making last swap: "+err.Error())
+			return 1
+		}
+
+		fmt.Fprintln(os.Stdout, c.Cid.String())
+
+		if updated {
+			fmt.Fprintln(os.Stderr, "updated")
+		} else {
+			fmt.Fprintln(os.Stderr, "non-updated")
+		}
+
+		return 0
+	})
+}
+
+// runPipeline sets up the temp cars and the send workers, fill adds the
+// blocks and its exit code is returned once every car is sent. The
+// incremental file is only dumped if incremental is set.
+func runPipeline(o runOptions, incremental bool, fill func(r *recursiveTraverser) int) int {
+	tempCars := make([]*os.File, o.inflightCars)
+	for i := range tempCars {
+		tempFileName := fmt.Sprintf(tempFileNamePattern, strconv.Itoa(i))
+		tempCar, err := os.OpenFile(tempFileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error openning tempCar: "+err.Error())
+			return 1
+		}
+		defer os.Remove(tempFileName)
+		defer tempCar.Close()
+		err = tempCar.Truncate(carMaxSize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error sizing tempCar: "+err.Error())
+			return 1
+		}
+		tempCars[i] = tempCar
 	}
-	defer os.Remove(tempFileName)
-	defer tempCarB.Close()
 
 	cancel := make(chan struct{})
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
 	{
 		var cancelOnce sync.Once
 		sig := make(chan os.Signal, 1)
@@ -246,6 +517,7 @@ func mainRet() int {
 					close(cancel)
 					signal.Stop(sig)
 				})
+				cancelCtx()
 			case <-cancel:
 			}
 		}()
@@ -256,7 +528,7 @@ func mainRet() int {
 	}
 
 	var dumpThrottleChan <-chan time.Time
-	if dumpThrottle <= 0 {
+	if o.dumpThrottle <= 0 {
 		c := make(chan time.Time)
 		go func() {
 			for {
@@ -269,82 +541,67 @@ func mainRet() int {
 		}()
 		dumpThrottleChan = c
 	} else {
-		t := time.NewTicker(dumpThrottle)
+		t := time.NewTicker(o.dumpThrottle)
 		defer t.Stop()
 		dumpThrottleChan = t.C
 	}
 
 	r := &recursiveTraverser{
-		tempCarChunk:           tempCarA,
-		tempCarSend:            tempCarB,
+		tempCarChunk:           tempCars[0],
 		tempCarOffset:          carMaxSize,
 		statEntries:            make(chan *doJobs, doJobsBuffer),
 		statError:              make(chan error),
 		cancel:                 cancel,
-		chunkT:                 make(chan struct{}, 1),
-		sendT:                  make(chan sendJobs, 1),
-		concurrentChunkerCount: concurrentChunkers,
-		send:                   driverToUse,
-		incrementalFile:        incrementalFile,
+		ctx:                    ctx,
+		freeCars:               make(chan *os.File, o.inflightCars),
+		sendT:                  make(chan sendJobs, o.inflightCars-1),
+		concurrentChunkerCount: o.concurrentChunkers,
+		drivers:                o.drivers,
+		replication:            o.replication,
+		routes:                 o.routes,
+		sectorFit:              o.sectorFit,
+		selfContained:          o.selfContained,
+		carRoots:               newCarRoots(),
+		uploadWindows:          o.uploadWindows,
+		target:                 o.target,
+		filter:                 o.filter,
+		incrementalFile:        o.incrementalFile,
+		receiptsFile:           o.incrementalFile + receiptsFileSuffix,
 		dumpJobs:               make(chan incrementalFormat),
 		dumpThrottle:           dumpThrottleChan,
 		dumpForceNow:           make(chan struct{}),
-		fallback:               carDriver{pathFormat: uploadFailedOut + "/%d.car"},
+	}
+	r.carLimit = r.limitFor(0)
+	for _, v := range tempCars[1:] {
+		r.freeCars <- v
 	}
 	var wg sync.WaitGroup
-	wg.Add(3)
-	go func() {
-		defer wg.Done()
-		r.statWorker(target)
-	}()
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer close(r.dumpJobs)
-		lastDumped := r.sendWorker()
+		lastDumped := r.sendWorkers(o.inflightCars - 1)
 		close(r.dumpForceNow)
 		if !lastDumped {
+			if r.selfContained {
+				resolveSavedCars(r.olds.Cids, r.carRoots)
+			}
 			r.dumpJobs <- r.olds
 		}
 	}()
 	go func() {
 		defer wg.Done()
+		if !incremental {
+			for range r.dumpJobs {
+			}
+			return
+		}
 		r.dumpWorker()
 	}()
 	defer wg.Wait()
 	defer close(r.sendT)
-	r.chunkT <- struct{}{}
 
-	r.olds, err = loadIncremental(incrementalFile)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "error loading incremental file: "+err.Error())
-		return 1
-	}
-
-	c, updated, err := r.do()
-	if err != nil {
-		if !errors.Is(err, errClosing) {
-			fmt.Fprintln(os.Stderr, "error doing: "+err.Error())
-		}
-		return 1
-	}
-	// swap if there is data remaining in the back buffer
-	if r.tempCarOffset != carMaxSize {
-		err = r.swap()
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "error making last swap: "+err.Error())
-			return 1
-		}
-	}
-
-	fmt.Fprintln(os.Stdout, c.Cid.String())
-
-	if updated {
-		fmt.Fprintln(os.Stderr, "updated")
-	} else {
-		fmt.Fprintln(os.Stderr, "non-updated")
-	}
-
-	return 0
+	return fill(r)
 }
 
 func (r *recursiveTraverser) statWorker(task string) {
@@ -380,6 +637,15 @@ func (r *recursiveTraverser) rStatWorker(task string, entry os.FileInfo) error {
 		if err != nil {
 			return fmt.Errorf("ReadDir %s: %w", task, err)
 		}
+		if !r.filter.empty() {
+			kept := subThings[:0]
+			for _, v := range subThings {
+				if r.filter.match((task + "/" + v.Name())[len(r.target)+1:], v.IsDir()) {
+					kept = append(kept, v)
+				}
+			}
+			subThings = kept
+		}
 		job.subThings = subThings
 	}
 
@@ -405,7 +671,79 @@ func (r *recursiveTraverser) rStatWorker(task string, entry os.FileInfo) error {
 	return nil
 }
 
-type driver func(headerBuffer []byte, car *os.File, carOffset int64) error
+// driver sends cars somewhere, Send may be called concurrently by the send
+// workers and Close is called once all cars have been sent.
+type driver interface {
+	Send(ctx context.Context, payload CarPayload) (Receipt, error)
+	Close() error
+}
+
+// CarPayload is a car ready to be sent, it is made of an in memory header
+// (the car header and fake roots) followed by the tail of a temp car file.
+type CarPayload struct {
+	Root cid.Cid
+	// Size is the full size of the car, header included.
+	Size int64
+	// Seq is the index of this car in the current run.
+	Seq uint64
+
+	Header    []byte
+	Car       *os.File
+	CarOffset int64
+
+	// Index lists the blocks of the car, padding blocks are only recorded
+	// alongside the blocks they follow.
+	Index []carIndexRecord
+	// Dependencies are the roots of the cars holding descendants of this
+	// car's roots, only set with -self-contained.
+	Dependencies []cid.Cid
+}
+
+// ReadAt reads the car as if it were one continuous file.
+func (p CarPayload) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	headerLen := int64(len(p.Header))
+	if off < headerLen {
+		n = copy(b, p.Header[off:])
+		if n == len(b) {
+			return n, nil
+		}
+		b = b[n:]
+		off = headerLen
+	}
+	m, err := io.NewSectionReader(p.Car, p.CarOffset, p.Size-headerLen).ReadAt(b, off-headerLen)
+	return n + m, err
+}
+
+// Reader returns a new reader over the whole car to upload it, it is limited
+// by -bandwidth-limit and stops waiting for it once ctx is done.
+func (p CarPayload) Reader(ctx context.Context) io.Reader {
+	return newUploadReader(ctx, io.NewSectionReader(p, 0, p.Size))
+}
+
+// expandCarTemplate replaces {root} and {n} by the car root and sequence
+// number in template.
+func expandCarTemplate(template string, p CarPayload) string {
+	return strings.NewReplacer(
+		"{root}", p.Root.String(),
+		"{n}", strconv.FormatUint(p.Seq, 10),
+	).Replace(template)
+}
+
+// Receipt is what a driver reports about a car it sent, Info holds the
+// driver specific parts of the remote's response.
+type Receipt struct {
+	Driver string            `json:"driver"`
+	Root   string            `json:"root"`
+	Size   int64             `json:"size"`
+	Time   time.Time         `json:"time"`
+	Info   map[string]string `json:"info,omitempty"`
+}
+
+// validateOnly makes driver factories and secrets only check their params,
+// nothing is created, written or run, config check sets it.
+var validateOnly bool
+
 type driverFactory func(params string) (driver, error)
 type driverHelper func(output io.Writer)
 
@@ -419,6 +757,90 @@ var drivers = map[string]driverCreator{
 	"estuary":      estuaryDriverCreator,
 	"car":          carDriverCreator,
 	"web3.storage": web3StorageDriverCreator,
+	"kubo":         kuboDriverCreator,
+	"pinning":      pinningDriverCreator,
+	"s3":           s3DriverCreator,
+	"flatfs":       flatfsDriverCreator,
+	"exec":         execDriverCreator,
+	"http":         httpDriverCreator,
+}
+
+type driverOptions map[string]string
+
+// parseDriverParams splits driver params of the form "positional,key=value,...",
+// the positional part is optional and must come first. A comma preceded by a
+// backslash is part of the value.
+func parseDriverParams(input string) (string, driverOptions, error) {
+	opts := driverOptions{}
+	if input == "" {
+		return "", opts, nil
+	}
+	var positional string
+	for i, v := range splitEscaped(input, ',') {
+		k, val, ok := strings.Cut(v, "=")
+		if !ok {
+			if i != 0 {
+				return "", nil, fmt.Errorf("unexpected positional %q, only the first param can be positional", v)
+			}
+			positional = v
+			continue
+		}
+		if _, dup := opts[k]; dup {
+			return "", nil, fmt.Errorf("option %q given more than once", k)
+		}
+		opts[k] = val
+	}
+	return positional, opts, nil
+}
+
+// splitEscaped splits s around sep, sep preceded by a backslash doesn't split
+// and is kept without the backslash. Other backslashes are left as is.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	var cur strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == sep:
+			i++
+			cur.WriteByte(sep)
+		case s[i] == sep:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+	return append(parts, cur.String())
+}
+
+// take removes option k and returns its value, or def if it wasn't given.
+func (o driverOptions) take(k, def string) string {
+	v, ok := o[k]
+	if !ok {
+		return def
+	}
+	delete(o, k)
+	return v
+}
+
+func (o driverOptions) takeBool(k string, def bool) (bool, error) {
+	v := o.take(k, "")
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("option %s: %w", k, err)
+	}
+	return b, nil
+}
+
+// done errors if some options were never taken.
+func (o driverOptions) done() error {
+	for k := range o {
+		return fmt.Errorf("unknown option %q", k)
+	}
+	return nil
 }
 
 func (r *recursiveTraverser) dumpWorker() {
@@ -437,69 +859,254 @@ func (r *recursiveTraverser) dumpWorker() {
 	}
 }
 
-func (r *recursiveTraverser) sendWorker() (lastDumped bool) {
-TaskLoop:
-	for task := range r.sendT {
-		lastDumped = false
-		if task.offset == carMaxSize || len(task.roots) == 0 {
-			// Empty car do nothing.
-			continue
-		}
-		header, offset, err := r.makeSendPayload(task)
-		if err != nil {
-			panic(fmt.Errorf("creating payload: %w", err))
-		}
-		err = r.tempCarSend.Sync()
-		if err != nil {
-			panic(fmt.Errorf("error syncing temp file: %w", err))
-		}
-		for failed := uint(0); failed != uploadTries; failed++ {
-			attemptCount := strconv.FormatUint(uint64(failed+1), 10) + " / " + strconv.FormatUint(uint64(uploadTries), 10)
-			err := r.send(header, r.tempCarSend, offset)
-			if err != nil {
-				talkLock.Lock()
-				fmt.Fprintln(os.Stderr, attemptCount+" error sending: "+err.Error())
-				talkLock.Unlock()
-				continue
+type sendResult struct {
+	seq      uint64
+	cids     incrementalFormat
+	receipts []Receipt
+}
+
+func (r *recursiveTraverser) sendWorkers(count int64) (lastDumped bool) {
+	done := make(chan sendResult)
+	var wg sync.WaitGroup
+	wg.Add(int(count))
+	for ; count != 0; count-- {
+		go func() {
+			defer wg.Done()
+			for task := range r.sendT {
+				done <- sendResult{task.seq, task.cids, r.sendCar(task)}
 			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// Cars can finish out of order but an incremental snapshot is only valid
+	// once every car before it has been sent, so commit them in order.
+	pending := make(map[uint64]sendResult)
+	var next uint64
+	for res := range done {
+		pending[res.seq] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
 
-			r.chunkT <- struct{}{}
+			for _, receipt := range res.receipts {
+				err := appendReceipt(r.receiptsFile, receipt)
+				if err != nil {
+					talkLock.Lock()
+					fmt.Fprintln(os.Stderr, "error saving receipt: "+err.Error())
+					talkLock.Unlock()
+				}
+			}
+
+			if r.selfContained {
+				resolveSavedCars(res.cids.Cids, r.carRoots)
+			}
+			lastDumped = false
 			// only dump if the dump worker is not busy
 			select {
-			case r.dumpJobs <- task.cids:
+			case r.dumpJobs <- res.cids:
 				lastDumped = true
 			default:
 			}
+		}
+	}
 
-			continue TaskLoop
+	for _, d := range r.drivers {
+		err := d.Close()
+		if err != nil {
+			talkLock.Lock()
+			fmt.Fprintln(os.Stderr, "error closing driver "+d.name+": "+redact(err.Error()))
+			talkLock.Unlock()
+		}
+	}
+	if len(r.drivers) > 1 {
+		talkLock.Lock()
+		for _, d := range r.drivers {
+			fmt.Fprintf(os.Stderr, "%s: %d sent, %d failed attempts, %d failed out\n", d.name, d.sent, d.failedAttempts, d.failedOuts)
 		}
+		talkLock.Unlock()
+	}
 
-		// Failed, copy to failedOut
-		r.makeFailedOutDir.Do(func() {
-			os.Mkdir(uploadFailedOut, 0o775)
-		})
+	return
+}
 
-		err = r.fallback.send(header, r.tempCarSend, offset)
-		if err != nil {
-			panic("error saving failed car: " + err.Error())
+func (r *recursiveTraverser) sendCar(task sendJobs) []Receipt {
+	defer r.releaseCar(task.car)
+	if task.offset == carMaxSize || len(task.roots) == 0 {
+		// Empty car do nothing.
+		return nil
+	}
+	payload, err := r.makeSendPayload(task)
+	if err != nil {
+		panic(fmt.Errorf("creating payload: %w", err))
+	}
+	r.checkSectorFit(payload)
+	if r.selfContained {
+		r.carRoots.set(task.seq, payload.Root)
+	}
+	err = task.car.Sync()
+	if err != nil {
+		panic(fmt.Errorf("error syncing temp file: %w", err))
+	}
+	r.waitUploadWindow()
+
+	drivers, replication := r.route(payload.Size)
+	var receipts []Receipt
+	var failed []*namedDriver
+	if replication.fallback {
+		for _, d := range drivers {
+			receipt := r.sendWithRetries(d, payload)
+			if receipt != nil {
+				receipts = append(receipts, *receipt)
+				break
+			}
+			failed = append(failed, d)
+		}
+		if len(receipts) == 0 {
+			// One copy is all we need, keep it with the primary.
+			failed = failed[:1]
+		}
+	} else {
+		results := make([]*Receipt, len(drivers))
+		var wg sync.WaitGroup
+		wg.Add(len(drivers))
+		for i, d := range drivers {
+			go func(i int, d *namedDriver) {
+				defer wg.Done()
+				results[i] = r.sendWithRetries(d, payload)
+			}(i, d)
+		}
+		wg.Wait()
+		for i, receipt := range results {
+			if receipt != nil {
+				receipts = append(receipts, *receipt)
+			} else {
+				failed = append(failed, drivers[i])
+			}
 		}
+	}
+	if len(receipts) >= replication.min {
+		return receipts
+	}
+
+	// Failed, copy to failedOut
+	for _, d := range failed {
+		receipts = append(receipts, r.failOut(d, payload))
+	}
+	return receipts
+}
 
-		r.chunkT <- struct{}{}
-		// only dump if the dump worker is not busy
+// waitUploadWindow blocks until uploads are allowed or we are shutting down.
+func (r *recursiveTraverser) waitUploadWindow() {
+	for {
+		wait := untilUploadWindow(r.uploadWindows, time.Now())
+		if wait == 0 {
+			return
+		}
+		talkLock.Lock()
+		fmt.Fprintln(os.Stderr, "waiting "+wait.Round(time.Second).String()+" for the upload window")
+		talkLock.Unlock()
+		t := time.NewTimer(wait)
 		select {
-		case r.dumpJobs <- task.cids:
-			lastDumped = true
-		default:
+		case <-t.C:
+		case <-r.ctx.Done():
+			t.Stop()
+			return
 		}
 	}
+}
 
-	return
+func (r *recursiveTraverser) sendWithRetries(d *namedDriver, payload CarPayload) *Receipt {
+	for failed := uint(0); failed != uploadTries; failed++ {
+		attemptCount := strconv.FormatUint(uint64(failed+1), 10) + " / " + strconv.FormatUint(uint64(uploadTries), 10)
+		receipt, err := d.Send(r.ctx, payload)
+		if err != nil {
+			atomic.AddUint64(&d.failedAttempts, 1)
+			talkLock.Lock()
+			fmt.Fprintln(os.Stderr, attemptCount+" error sending to "+d.name+": "+redact(err.Error()))
+			talkLock.Unlock()
+			if r.ctx.Err() != nil {
+				// Shutting down, don't retry and save the car instead.
+				break
+			}
+			continue
+		}
+		atomic.AddUint64(&d.sent, 1)
+		return fillReceipt(receipt, d.name, payload)
+	}
+	return nil
+}
+
+func (r *recursiveTraverser) failOut(d *namedDriver, payload CarPayload) Receipt {
+	d.makeFailedOutDir.Do(func() {
+		os.MkdirAll(d.failedOutDir, 0o775)
+	})
+
+	receipt, err := d.failedOut.Send(context.Background(), payload)
+	if err != nil {
+		panic("error saving failed car: " + err.Error())
+	}
+	atomic.AddUint64(&d.failedOuts, 1)
+	return *fillReceipt(receipt, "failed-outs", payload)
+}
+
+func fillReceipt(receipt Receipt, driverName string, payload CarPayload) *Receipt {
+	receipt.Driver = driverName
+	receipt.Root = payload.Root.String()
+	receipt.Size = payload.Size
+	receipt.Time = time.Now()
+	return &receipt
 }
 
-func (r *recursiveTraverser) makeSendPayload(job sendJobs) ([]byte, int64, error) {
-	cidsToLink := make([]*pb.PBLink, len(job.roots))
-	padSize := len(strconv.FormatUint(uint64(len(job.roots)-1), 32))
-	for i, v := range job.roots {
+// checkReturnedCid makes sure the root a remote says it received is the one
+// we sent, this catches truncated bodies and proxies mangling the upload.
+func checkReturnedCid(returned string, root cid.Cid) error {
+	c, err := cid.Decode(returned)
+	if err != nil {
+		return fmt.Errorf("decoding returned cid %q: %w", returned, err)
+	}
+	if c.Type() != root.Type() || !bytes.Equal(c.Hash(), root.Hash()) {
+		return fmt.Errorf("returned cid %s doesn't match car root %s", c, root)
+	}
+	return nil
+}
+
+// releaseCar gives a sent temp car back to the chunker.
+func (r *recursiveTraverser) releaseCar(car *os.File) {
+	// Truncate now instead of on reuse so idle buffers don't hold disk space.
+	err := car.Truncate(0)
+	if err != nil {
+		panic(fmt.Errorf("error truncating temp file: %w", err))
+	}
+	// Keep it full size but sparse, the padding bodies are holes and must
+	// read as zeros even past the last write.
+	err = car.Truncate(carMaxSize)
+	if err != nil {
+		panic(fmt.Errorf("error sizing temp file: %w", err))
+	}
+	r.freeCars <- car
+}
+
+func (r *recursiveTraverser) makeSendPayload(job sendJobs) (CarPayload, error) {
+	roots := job.roots
+	var deps []cid.Cid
+	if r.selfContained {
+		var err error
+		roots, deps, err = r.selfContainedRoots(job.roots)
+		if err != nil {
+			return CarPayload{}, err
+		}
+	}
+	cidsToLink := make([]*pb.PBLink, len(roots))
+	padSize := len(strconv.FormatUint(uint64(len(roots)-1), 32))
+	for i, v := range roots {
 		sSize := uint64(v.DagSize)
 		n := zeroPad(strconv.FormatUint(uint64(i), 32), padSize)
 		cidsToLink[i] = &pb.PBLink{
@@ -526,7 +1133,7 @@ func (r *recursiveTraverser) makeSendPayload(job sendJobs) ([]byte, int64, error
 				Data:  directoryData,
 			})
 			if err != nil {
-				return nil, 0, fmt.Errorf("serialising fake root: %w", err)
+				return CarPayload{}, fmt.Errorf("serialising fake root: %w", err)
 			}
 			lastAttempt = median
 
@@ -555,7 +1162,7 @@ func (r *recursiveTraverser) makeSendPayload(job sendJobs) ([]byte, int64, error
 					Data:  directoryData,
 				})
 				if err != nil {
-					return nil, 0, fmt.Errorf("serialising fake root: %w", err)
+					return CarPayload{}, fmt.Errorf("serialising fake root: %w", err)
 				}
 			}
 		}
@@ -574,7 +1181,7 @@ func (r *recursiveTraverser) makeSendPayload(job sendJobs) ([]byte, int64, error
 		h := sha256.Sum256(blockData)
 		mhash, err := mh.Encode(h[:], mh.SHA2_256)
 		if err != nil {
-			return nil, 0, fmt.Errorf("encoding multihash: %w", err)
+			return CarPayload{}, fmt.Errorf("encoding multihash: %w", err)
 		}
 		c := cid.NewCidV1(cid.DagProtobuf, mhash)
 		data = append(append(append(varuintHeader, c.Bytes()...), blockData...), data...)
@@ -589,22 +1196,54 @@ func (r *recursiveTraverser) makeSendPayload(job sendJobs) ([]byte, int64, error
 	// Writing CAR header
 	c, err := cid.Cast(cidsToLink[0].Hash)
 	if err != nil {
-		return nil, 0, fmt.Errorf("casting CID back from bytes: %w", err)
+		return CarPayload{}, fmt.Errorf("casting CID back from bytes: %w", err)
 	}
 	headerBuffer, err := cbor.DumpObject(carHeader{
 		Roots:   []cid.Cid{c},
 		Version: 1,
 	})
 	if err != nil {
-		return nil, 0, fmt.Errorf("serialising header: %w", err)
+		return CarPayload{}, fmt.Errorf("serialising header: %w", err)
 	}
 
 	varuintHeader := make([]byte, binary.MaxVarintLen64+uint64(len(headerBuffer))+uint64(len(data)))
 	uvarintSize := binary.PutUvarint(varuintHeader, uint64(len(headerBuffer)))
-	return append(append(varuintHeader[:uvarintSize], headerBuffer...), data...), job.offset, nil
+	header := append(append(varuintHeader[:uvarintSize], headerBuffer...), data...)
+
+	index := make([]carIndexRecord, 0, len(job.roots)+len(data)/int(blockTarget)+1)
+	err = readCarBlocks(bytes.NewReader(header), int64(uvarintSize+len(headerBuffer)), int64(len(header)), func(b carBlock) error {
+		index = append(index, carIndexRecord{Cid: b.Cid, Offset: b.Start, Length: b.Offset + b.Length - b.Start})
+		return nil
+	})
+	if err != nil {
+		return CarPayload{}, fmt.Errorf("indexing fake roots: %w", err)
+	}
+	for _, v := range job.roots {
+		index = append(index, carIndexRecord{
+			Cid:     v.Cid,
+			Offset:  int64(len(header)) + v.Offset - job.offset,
+			Length:  v.Length,
+			Padding: v.Padding,
+			Path:    v.Path,
+			Node:    v.Node,
+		})
+	}
+
+	return CarPayload{
+		Root:         c,
+		Size:         int64(len(header)) + carMaxSize - job.offset,
+		Seq:          job.seq,
+		Header:       header,
+		Car:          job.car,
+		CarOffset:    job.offset,
+		Index:        index,
+		Dependencies: deps,
+	}, nil
 }
 
-func (r *recursiveTraverser) writePBNode(data []byte) (cid.Cid, bool, error) {
+// writePBNode writes a dag-pb node and returns its CID and its block in the
+// car.
+func (r *recursiveTraverser) writePBNode(data []byte, task string) (cid.Cid, *cidSizePair, bool, error) {
 	// Making block header
 	varuintHeader := make([]byte, binary.MaxVarintLen64+dagPBCIDLength+len(data))
 	uvarintSize := binary.PutUvarint(varuintHeader, uint64(dagPBCIDLength)+uint64(len(data)))
@@ -615,62 +1254,91 @@ func (r *recursiveTraverser) writePBNode(data []byte) (cid.Cid, bool, error) {
 	h := sha256.Sum256(data)
 	mhash, err := mh.Encode(h[:], mh.SHA2_256)
 	if err != nil {
-		return cid.Cid{}, false, fmt.Errorf("encoding multihash: %w", err)
+		return cid.Cid{}, nil, false, fmt.Errorf("encoding multihash: %w", err)
 	}
 	fakeLeaf := cid.NewCidV1(cid.Raw, mhash)
 	rootBlock := append(append(varuintHeader, fakeLeaf.Bytes()...), data...)
-	r.toSend = append(r.toSend, &cidSizePair{
-		Cid:      fakeLeaf,
-		FileSize: fullSize,
-		DagSize:  fullSize,
-	})
 
 	off, swapped, err := r.takeOffset(fullSize)
 	if err != nil {
-		return cid.Cid{}, false, fmt.Errorf("taking offset: %w", err)
+		return cid.Cid{}, nil, false, fmt.Errorf("taking offset: %w", err)
 	}
+	// Append after taking the offset, a swap must not send it with the
+	// previous car.
+	block := &cidSizePair{
+		Cid:      fakeLeaf,
+		FileSize: fullSize,
+		DagSize:  fullSize,
+		Offset:   off,
+		Length:   fullSize,
+		Path:     task,
+		Node:     true,
+	}
+	r.addToSend(block)
 	_, err = r.tempCarChunk.WriteAt(rootBlock, off)
 	if err != nil {
-		return cid.Cid{}, false, fmt.Errorf("writing root's header: %w", err)
+		return cid.Cid{}, nil, false, fmt.Errorf("writing root's header: %w", err)
 	}
 
-	return cid.NewCidV1(cid.DagProtobuf, mhash), swapped, nil
+	return cid.NewCidV1(cid.DagProtobuf, mhash), block, swapped, nil
 }
 
 type sendJobs struct {
 	roots  []*cidSizePair
+	car    *os.File
 	offset int64
+	seq    uint64
 	cids   incrementalFormat
 }
 
 type recursiveTraverser struct {
 	tempCarOffset int64
 	tempCarChunk  *os.File
-	tempCarSend   *os.File
+	carCounter    uint64
 
 	statEntries chan *doJobs
 	statError   chan error
 	cancel      chan struct{}
+	ctx         context.Context
 
-	chunkT chan struct{}
-	sendT  chan sendJobs
+	freeCars chan *os.File
+	sendT    chan sendJobs
 
 	dumpJobs     chan incrementalFormat
 	dumpThrottle <-chan time.Time
 	dumpForceNow chan struct{}
 
-	send     driver
-	fallback carDriver
+	drivers     []*namedDriver
+	replication replicationPolicy
+	routes      []route
+	// carLimit if not zero is the maximum size of the current car including
+	// the header and fakeroots, it is enforced when picking when to swap.
+	carLimit int64
+	// pending estimates the bytes about to be written together, the limit of
+	// a car started while writing them is picked for them.
+	pending int64
+	// sectorFit if not zero is the unpadded size of the sector cars must fit.
+	sectorFit int64
+	// selfContained makes the fake roots link complete DAGs, carRoots are
+	// the roots of the cars of this run their dependencies are listed by.
+	selfContained bool
+	carRoots      *carRoots
+	// carBlocks counts blocks in the current car to estimate the fakeroots.
+	carBlocks int64
+
+	uploadWindows []uploadWindow
+
+	target        string
+	filter        pathFilter
+	filterChanged bool
 
 	concurrentChunkerCount int64
 
 	toSend []*cidSizePair
 
-	makeFailedOutDir sync.Once
-	failedOutCounter uint32
-
 	olds            incrementalFormat
 	incrementalFile string
+	receiptsFile    string
 }
 
 type doJobs struct {
@@ -686,13 +1354,17 @@ func (r *recursiveTraverser) pullBlock() sendJobs {
 	}
 
 	j := sendJobs{roots: r.toSend,
+		car:    r.tempCarChunk,
 		offset: r.tempCarOffset,
+		seq:    r.carCounter,
 		cids: incrementalFormat{
 			Version: r.olds.Version,
 			Cids:    curCids,
+			Filter:  r.olds.Filter,
 		},
 	}
 	r.toSend = nil
+	r.carCounter++
 	return j
 }
 
@@ -700,6 +1372,29 @@ type cidSizePair struct {
 	Cid      cid.Cid
 	FileSize int64
 	DagSize  int64
+	// Offset and Length locate the block section in the temp car, they and
+	// the fields below are only set for blocks in toSend.
+	Offset int64
+	Length int64
+	// Padding is the length of the padding block following this one.
+	Padding int64
+	// Path is the file or directory this block belongs to.
+	Path string
+	// Node is set for dag-pb nodes, they are stored under a raw CID.
+	Node bool
+
+	// The fields below are only tracked with -self-contained.
+	// Car is the seq of the car holding this block, Linked is set if a block
+	// of the same car links it and Link is the CID to link it with when it
+	// isn't the one it is stored with, they are set for blocks in toSend.
+	Car    uint64
+	Linked bool
+	Link   cid.Cid
+	// Block is the block of this DAG's root in toSend, nil if it wasn't
+	// written by this run.
+	Block *cidSizePair
+	// Deps are the cars holding this DAG's descendants other than Block's.
+	Deps carSet
 }
 
 func (cp *cidSizePair) String() string {
@@ -777,7 +1472,7 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 		}, new, nil
 
 	case os.ModeDir:
-		new := !oldExists || ctime.After(old.LastUpdate)
+		new := !oldExists || ctime.After(old.LastUpdate) || r.filterChanged
 
 		links := make([]*pb.PBLink, len(job.subThings))
 
@@ -808,10 +1503,7 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 			if err != nil {
 				return nil, false, fmt.Errorf("decoding old cid \"%s\": %w", old.Cid, err)
 			}
-			return &cidSizePair{
-				Cid:     c,
-				DagSize: old.DagSize,
-			}, false, nil
+			return r.reused(c, 0, old.DagSize, old), false, nil
 		}
 
 		data, err := proto.Marshal(&pb.PBNode{
@@ -827,10 +1519,11 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 
 		dagSum += int64(len(data))
 
-		c, _, err := r.writePBNode(data)
+		c, block, _, err := r.writePBNode(data, job.task)
 		if err != nil {
 			return nil, false, fmt.Errorf("writing directory %s: %w", job.task, err)
 		}
+		cp := r.trackDAG(block, c, 0, dagSum, sCids)
 
 		if oldExists {
 			new = c.String() != old.Cid
@@ -838,16 +1531,15 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 			new = true
 		}
 		if new {
-			r.olds.Cids[job.task] = &savedCidsPairs{
+			s := &savedCidsPairs{
 				Cid:        c.String(),
 				DagSize:    dagSum,
 				LastUpdate: ctime,
 			}
+			r.savedCars(s, cp)
+			r.olds.Cids[job.task] = s
 		}
-		return &cidSizePair{
-			Cid:     c,
-			DagSize: dagSum,
-		}, new, nil
+		return cp, new, nil
 
 	default:
 		// File
@@ -857,10 +1549,7 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 			if err != nil {
 				return nil, false, fmt.Errorf("decoding old cid \"%s\": %w", old.Cid, err)
 			}
-			return &cidSizePair{
-				Cid:     c,
-				DagSize: old.DagSize,
-			}, false, nil
+			return r.reused(c, 0, old.DagSize, old), false, nil
 		}
 
 		f, err := os.Open(job.task)
@@ -872,6 +1561,7 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 		var c *cidSizePair
 		oldOffset := r.tempCarOffset
 		oldToSendLen := len(r.toSend)
+		oldCarBlocks := r.carBlocks
 		size := job.entry.Size()
 		// This check is really important and doesn't only deal with inlining
 		// This ensures that no zero sized files is chunked (the chunker would fail horribly with thoses)
@@ -892,6 +1582,16 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 			}
 
 		} else {
+			r.expectFile(size)
+			defer r.expectWork(0)
+			if swapped, err := r.makeRoomForFile(size); err != nil {
+				return nil, false, err
+			} else if swapped {
+				oldOffset = carMaxSize
+				oldToSendLen = 0
+				oldCarBlocks = 0
+			}
+
 			blockCount := (size-1)/blockTarget + 1
 			CIDs := make([]*cidSizePair, blockCount)
 			manager := &concurrentChunkerManager{
@@ -926,10 +1626,10 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 						toPad += diskAssumedBlockSize
 					}
 				}
+				// The first block of a car is padded too, its padding is part
+				// of the car's size and must be a valid block.
 				fullSize += int64(toPad)
 
-				writePadBlock := r.tempCarOffset != carMaxSize // If that true that mean we are writting the first (so end because we write backward) block, so no need to write padding
-
 				carOffset, needSwap := r.mayTakeOffset(fullSize)
 
 				if needSwap {
@@ -937,8 +1637,9 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 					if err != nil {
 						return nil, false, err
 					}
-					r.toSend = append(r.toSend, CIDs[sentCounter:i]...)
+					r.addToSend(CIDs[sentCounter:i]...)
 					sentCounter = i
+					r.expectFile(size - i*blockTarget)
 					err = r.swap()
 					if err != nil {
 						return nil, false, fmt.Errorf("swapping: %w", err)
@@ -946,6 +1647,7 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 					manager.populate()
 					oldOffset = carMaxSize
 					oldToSendLen = 0
+					oldCarBlocks = 0
 					if !noPad {
 						toPad = (uint64(r.tempCarOffset)%diskAssumedBlockSize + diskAssumedBlockSize - uint64(workSize)%diskAssumedBlockSize) % diskAssumedBlockSize
 						if toPad != 0 && toPad < fakeBlockMinLength {
@@ -954,15 +1656,11 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 						}
 						fullSize = int64(toPad) + dataSize
 					}
-					writePadBlock = false
 					r.tempCarOffset -= fullSize
+					r.carBlocks++
 					carOffset = r.tempCarOffset
 				}
 
-				if !writePadBlock {
-					toPad = 0
-				}
-
 				err := manager.getChunkToken()
 				if err != nil {
 					return nil, false, err
@@ -975,7 +1673,7 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 			if err != nil {
 				return nil, false, err
 			}
-			r.toSend = append(r.toSend, CIDs[sentCounter:]...)
+			r.addToSend(CIDs[sentCounter:]...)
 
 			if len(CIDs) == 0 {
 				panic("Internal bug!")
@@ -1038,17 +1736,18 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 						dagSum += v.DagSize
 					}
 
-					c, swapped, err := r.writePBNode(lastRoot)
+					c, block, swapped, err := r.writePBNode(lastRoot, job.task)
 					if err != nil {
 						return nil, false, fmt.Errorf("writing root for %s: %w", job.task, err)
 					}
 					if swapped {
 						oldOffset = carMaxSize
 						oldToSendLen = 0
+						oldCarBlocks = 0
 					}
+					cp := r.trackDAG(block, c, fileSum, dagSum, CIDs[:low])
 					CIDs = CIDs[low:]
 
-					cp := &cidSizePair{c, fileSum, dagSum}
 					newRoots = append(newRoots, cp)
 				}
 				CIDs = newRoots
@@ -1063,11 +1762,13 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 			new = true
 		}
 		if new {
-			r.olds.Cids[job.task] = &savedCidsPairs{
+			s := &savedCidsPairs{
 				Cid:        c.Cid.String(),
 				DagSize:    c.DagSize,
 				LastUpdate: ctime,
 			}
+			r.savedCars(s, c)
+			r.olds.Cids[job.task] = s
 		} else {
 			// Zero (punch actually to free up disk blocks) data we unremove
 			sizeToRemove := oldOffset - r.tempCarOffset
@@ -1084,6 +1785,9 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 				}
 				r.tempCarOffset = oldOffset
 				r.toSend = r.toSend[:oldToSendLen]
+				r.carBlocks = oldCarBlocks
+				// The blocks are in the cars of the previous run.
+				c = r.reused(c.Cid, c.FileSize, c.DagSize, old)
 			}
 		}
 		return c, new, nil
@@ -1092,19 +1796,26 @@ func (r *recursiveTraverser) do() (*cidSizePair, bool, error) {
 
 var errClosing = errors.New("shutting down")
 
+// flush swaps if there is data remaining in the back buffer.
+func (r *recursiveTraverser) flush() error {
+	if r.tempCarOffset == carMaxSize {
+		return nil
+	}
+	return r.swap()
+}
+
 func (r *recursiveTraverser) swap() error {
+	var next *os.File
 	select {
 	case <-r.cancel:
 		return errClosing
-	case <-r.chunkT:
+	case next = <-r.freeCars:
 	}
-	r.tempCarSend, r.tempCarChunk = r.tempCarChunk, r.tempCarSend
 	r.sendT <- r.pullBlock()
-	err := r.tempCarChunk.Truncate(0)
-	if err != nil {
-		return err
-	}
+	r.tempCarChunk = next
 	r.tempCarOffset = carMaxSize
+	r.carBlocks = 0
+	r.carLimit = r.limitFor(r.pending)
 	return nil
 }
 
@@ -1166,6 +1877,10 @@ func (r *recursiveTraverser) mkChunk(manager *concurrentChunkerManager, f *os.Fi
 			Cid:      c,
 			FileSize: workSize,
 			DagSize:  workSize,
+			Offset:   carOffset,
+			Length:   blockHeaderSize + workSize,
+			Padding:  int64(toPad),
+			Path:     task,
 		}
 
 		_, err = r.tempCarChunk.WriteAt(append(varuintHeader, c.Bytes()...), carOffset)
@@ -1215,7 +1930,7 @@ func createPadBlockHeader(toPad uint16) []byte {
 }
 
 func (r *recursiveTraverser) takeOffset(size int64) (int64, bool, error) {
-	swapped := r.tempCarOffset < size
+	swapped := r.tempCarOffset < size || r.overLimit(size)
 	if swapped {
 		err := r.swap()
 		if err != nil {
@@ -1223,41 +1938,58 @@ func (r *recursiveTraverser) takeOffset(size int64) (int64, bool, error) {
 		}
 	}
 	r.tempCarOffset -= size
+	r.carBlocks++
 	return r.tempCarOffset, swapped, nil
 }
 
 func (r *recursiveTraverser) mayTakeOffset(size int64) (int64, bool) {
-	if r.tempCarOffset < size {
+	if r.tempCarOffset < size || r.overLimit(size) {
 		return 0, true
 	}
 	r.tempCarOffset -= size
+	r.carBlocks++
 	return r.tempCarOffset, false
 }
 
 func (r *recursiveTraverser) writeToBackBuffer(read *os.File, roff int64, woff int64, l int) error {
+	return copyFileRange(r.tempCarChunk, woff, read, roff, int64(l))
+}
+
+// copyFileRange copies l bytes of read at roff to write at woff, it uses
+// copy_file_range so the data is reflinked when the filesystem can.
+func copyFileRange(write *os.File, woff int64, read *os.File, roff int64, l int64) error {
 	rsc, err := read.SyscallConn()
 	if err != nil {
 		return fmt.Errorf("openning SyscallConn of read: %w", err)
 	}
 	var errr error
 	err = rsc.Control(func(rfd uintptr) {
-		wsc, err := r.tempCarChunk.SyscallConn()
+		wsc, err := write.SyscallConn()
 		if err != nil {
 			errr = fmt.Errorf("openning SyscallConn of write: %w", err)
 			return
 		}
 		err = wsc.Control(func(wfd uintptr) {
 			for l != 0 {
-				n, err := unix.CopyFileRange(int(rfd), &roff, int(wfd), &woff, l, 0)
+				toCopy := l
+				if toCopy > 1<<30 {
+					toCopy = 1 << 30
+				}
+				n, err := unix.CopyFileRange(int(rfd), &roff, int(wfd), &woff, int(toCopy), 0)
 				if err != nil {
-					if err == io.EOF {
-						errr = err
+					if err == unix.EXDEV || err == unix.ENOSYS || err == unix.EOPNOTSUPP {
+						// Not on the same filesystem or not supported, copy by hand.
+						errr = slowCopyRange(write, woff, read, roff, l)
 					} else {
-						errr = fmt.Errorf("zero-copying to back buffer: %w", err)
+						errr = fmt.Errorf("zero-copying: %w", err)
 					}
 					return
 				}
-				l -= n
+				if n == 0 {
+					errr = io.ErrUnexpectedEOF
+					return
+				}
+				l -= int64(n)
 			}
 		})
 		if err != nil {
@@ -1270,6 +2002,31 @@ func (r *recursiveTraverser) writeToBackBuffer(read *os.File, roff int64, woff i
 	return errr
 }
 
+func slowCopyRange(write *os.File, woff int64, read *os.File, roff int64, l int64) error {
+	buff := make([]byte, 1024*1024)
+	for l != 0 {
+		b := buff
+		if int64(len(b)) > l {
+			b = b[:l]
+		}
+		err := fullReadAt(read, b, roff)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("reading: %w", err)
+		}
+		_, err = write.WriteAt(b, woff)
+		if err != nil {
+			return fmt.Errorf("writing: %w", err)
+		}
+		roff += int64(len(b))
+		woff += int64(len(b))
+		l -= int64(len(b))
+	}
+	return nil
+}
+
 func fullReadAt(w io.ReaderAt, buff []byte, off int64) error {
 	toRead := int64(len(buff))
 	var red int64
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+const carManifestSuffix = ".manifest."
+
+// carManifest describes a car written by the car driver, offsets are from
+// the start of the file.
+type carManifest struct {
+	Root    cid.Cid              `json:"root" refmt:"root"`
+	Version uint64               `json:"version" refmt:"version"`
+	Size    int64                `json:"size" refmt:"size"`
+	Blocks  []carManifestBlock   `json:"blocks" refmt:"blocks"`
+	Files   []string             `json:"files" refmt:"files"`
+	Padding []carManifestPadding `json:"padding" refmt:"padding"`
+	// PieceCid and PieceSize are the Filecoin CommP and padded piece size.
+	PieceCid  *cid.Cid `json:"pieceCid,omitempty" refmt:"pieceCid,omitempty"`
+	PieceSize uint64   `json:"pieceSize,omitempty" refmt:"pieceSize,omitempty"`
+	// Dependencies are the roots of the earlier cars holding descendants of
+	// this car's DAGs.
+	Dependencies []cid.Cid `json:"dependencies,omitempty" refmt:"dependencies,omitempty"`
+}
+
+// carManifestBlock is a block section, length varint and CID included.
+type carManifestBlock struct {
+	Cid    cid.Cid `json:"cid" refmt:"cid"`
+	Offset int64   `json:"offset" refmt:"offset"`
+	Length int64   `json:"length" refmt:"length"`
+	Path   string  `json:"path,omitempty" refmt:"path,omitempty"`
+}
+
+type carManifestPadding struct {
+	Offset int64 `json:"offset" refmt:"offset"`
+	Length int64 `json:"length" refmt:"length"`
+}
+
+func init() {
+	cbor.RegisterCborType(carManifest{})
+	cbor.RegisterCborType(carManifestBlock{})
+	cbor.RegisterCborType(carManifestPadding{})
+}
+
+// makeCarManifest builds the manifest of payload written at base with a
+// padding block of padHeader bytes after its header.
+func makeCarManifest(payload CarPayload, version uint64, size, base, padHeader int64) carManifest {
+	headerLen := int64(len(payload.Header))
+	m := carManifest{
+		Root:    payload.Root,
+		Version: version,
+		Size:    size,
+		Blocks:  make([]carManifestBlock, len(payload.Index)),
+		Files:   []string{},
+
+		Dependencies: payload.Dependencies,
+	}
+	if padHeader != 0 {
+		m.Padding = append(m.Padding, carManifestPadding{Offset: base + headerLen, Length: padHeader})
+	}
+
+	files := map[string]struct{}{}
+	for i, r := range payload.Index {
+		offset := base + r.Offset
+		if r.Offset >= headerLen {
+			offset += padHeader
+		}
+		m.Blocks[i] = carManifestBlock{
+			Cid:    r.Cid,
+			Offset: offset,
+			Length: r.Length,
+			Path:   r.Path,
+		}
+		if r.Padding != 0 {
+			m.Padding = append(m.Padding, carManifestPadding{Offset: offset + r.Length, Length: r.Padding})
+		}
+		if _, ok := files[r.Path]; !ok && r.Path != "" {
+			files[r.Path] = struct{}{}
+			m.Files = append(m.Files, r.Path)
+		}
+	}
+	sort.Slice(m.Blocks, func(i, j int) bool { return m.Blocks[i].Offset < m.Blocks[j].Offset })
+	sort.Slice(m.Padding, func(i, j int) bool { return m.Padding[i].Offset < m.Padding[j].Offset })
+	sort.Strings(m.Files)
+	return m
+}
+
+// writeCarManifest writes m next to the car at carPath in format (json or
+// cbor) and returns the manifest path.
+func writeCarManifest(carPath, format string, m carManifest) (string, error) {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = json.Marshal(m)
+	case "cbor":
+		data, err = cbor.DumpObject(m)
+	default:
+		panic("unknown manifest format " + format)
+	}
+	if err != nil {
+		return "", fmt.Errorf("serialising manifest: %w", err)
+	}
+	path := carPath + carManifestSuffix + format
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("writing manifest: %w", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	envPinningEndpointKey = "PINNING_SERVICE_ENDPOINT"
+	envPinningKeyKey      = "PINNING_SERVICE_KEY"
+
+	defaultPinningPoll    = time.Second * 5
+	defaultPinningTimeout = time.Hour * 24
+)
+
+var pinningDriverCreator = driverCreator{
+	factory:    newPinningDriver,
+	help:       pinningHelp,
+	maxCarSize: 1 << 42, // Nothing is uploaded to the pinning service itself
+}
+
+func pinningHelp(out io.Writer) {
+	fmt.Fprint(out, `  Environ:
+  - `+envPinningEndpointKey+` pinning service API endpoint (without the trailing /pins)
+  - `+envPinningKeyKey+` pinning service API key (secret)
+  Options:
+  - kubo=<API> import the car into this kubo node first, its addresses are sent as origins
+  - car=<PATH_FORMAT> write the car on disk first, for a node serving that directory,
+    it is removed if pinning fails
+  - origins=<multiaddr>[;<multiaddr>...] extra origins to send
+  - name=<NAME> name of the pins, defaults to the root cid
+  - poll=<duration> pin status poll interval, defaults to `+defaultPinningPoll.String()+`
+  - timeout=<duration> how long to wait for a pin to leave queued or pinning,
+    defaults to `+defaultPinningTimeout.String()+`
+  One of kubo= or car= is required, the service has to fetch the car's blocks
+  from somewhere.
+
+`)
+}
+
+func newPinningDriver(input string) (driver, error) {
+	positional, opts, err := parseDriverParams(input)
+	if err != nil {
+		return nil, err
+	}
+	if positional != "" {
+		return nil, fmt.Errorf("unexpected pinning positional argument: %q", positional)
+	}
+
+	key, err := getSecret(envPinningKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := os.Getenv(envPinningEndpointKey)
+
+	if key == "" {
+		return nil, fmt.Errorf("error empty " + envPinningKeyKey + " envKey")
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("error empty " + envPinningEndpointKey + " envKey")
+	}
+
+	d := &pinningDriver{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/pins",
+		key:      key,
+		name:     opts.take("name", ""),
+		client:   newHTTPClient(),
+	}
+
+	if api := opts.take("kubo", ""); api != "" {
+		base, client, err := newKuboClient(api)
+		if err != nil {
+			return nil, err
+		}
+		d.kubo = &kuboDriver{base: base, pin: true, client: client}
+	}
+	if pathFormat := opts.take("car", ""); pathFormat != "" {
+		d.car = &carDriver{pathFormat: pathFormat}
+	}
+	if origins := opts.take("origins", ""); origins != "" {
+		d.origins = strings.Split(origins, ";")
+	}
+	d.poll = defaultPinningPoll
+	if poll := opts.take("poll", ""); poll != "" {
+		d.poll, err = time.ParseDuration(poll)
+		if err != nil {
+			return nil, fmt.Errorf("option poll: %w", err)
+		}
+		if d.poll <= 0 {
+			return nil, fmt.Errorf("option poll must be positive")
+		}
+	}
+	d.timeout = defaultPinningTimeout
+	if timeout := opts.take("timeout", ""); timeout != "" {
+		d.timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("option timeout: %w", err)
+		}
+		if d.timeout <= 0 {
+			return nil, fmt.Errorf("option timeout must be positive")
+		}
+	}
+	err = opts.done()
+	if err != nil {
+		return nil, err
+	}
+	if d.kubo == nil && d.car == nil {
+		return nil, fmt.Errorf("pinning requires kubo= or car= so the service can fetch the blocks")
+	}
+
+	return d, nil
+}
+
+type pinningDriver struct {
+	endpoint string
+	key      string
+	name     string
+	origins  []string
+	poll     time.Duration
+	timeout  time.Duration
+
+	kubo *kuboDriver
+	car  *carDriver
+
+	client *http.Client
+}
+
+type pinningStatus struct {
+	RequestId string            `json:"requestid"`
+	Status    string            `json:"status"`
+	Delegates []string          `json:"delegates"`
+	Info      map[string]string `json:"info"`
+	Pin       struct {
+		Cid string `json:"cid"`
+	} `json:"pin"`
+}
+
+func (p *pinningDriver) Send(ctx context.Context, payload CarPayload) (Receipt, error) {
+	if p.car == nil {
+		return p.pin(ctx, payload)
+	}
+	car, err := p.car.Send(ctx, payload)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("writing car: %w", err)
+	}
+	receipt, err := p.pin(ctx, payload)
+	if err != nil {
+		// Retries write a new car, don't leave this one behind.
+		os.Remove(car.Info["path"])
+		return Receipt{}, err
+	}
+	receipt.Info["car"] = car.Info["path"]
+	return receipt, nil
+}
+
+func (p *pinningDriver) pin(ctx context.Context, payload CarPayload) (Receipt, error) {
+	origins := p.origins
+	if p.kubo != nil {
+		_, err := p.kubo.Send(ctx, payload)
+		if err != nil {
+			return Receipt{}, fmt.Errorf("importing in kubo: %w", err)
+		}
+		var id struct {
+			Addresses []string
+		}
+		err = p.kubo.rpc(ctx, "id", nil, &id)
+		if err != nil {
+			return Receipt{}, err
+		}
+		origins = append(id.Addresses, origins...)
+	}
+	root := payload.Root.String()
+	name := p.name
+	if name == "" {
+		name = root
+	}
+	body, err := json.Marshal(struct {
+		Cid     string   `json:"cid"`
+		Name    string   `json:"name"`
+		Origins []string `json:"origins,omitempty"`
+	}{root, name, origins})
+	if err != nil {
+		return Receipt{}, fmt.Errorf("encoding pin request: %w", err)
+	}
+	status, err := p.do(ctx, "POST", p.endpoint, body, http.StatusAccepted)
+	if err != nil {
+		return Receipt{}, err
+	}
+	err = checkReturnedCid(status.Pin.Cid, payload.Root)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	if p.kubo != nil {
+		// The service tells us where to connect to speed up the transfer.
+		for _, d := range status.Delegates {
+			err := p.kubo.rpc(ctx, "swarm/connect", url.Values{"arg": {d}}, nil)
+			if err != nil {
+				talkLock.Lock()
+				fmt.Fprintln(os.Stderr, "error connecting to pinning delegate: "+redact(err.Error()))
+				talkLock.Unlock()
+			}
+		}
+	}
+
+	deadline := time.NewTimer(p.timeout)
+	defer deadline.Stop()
+	t := time.NewTicker(p.poll)
+	defer t.Stop()
+	for status.Status == "queued" || status.Status == "pinning" {
+		select {
+		case <-ctx.Done():
+			return Receipt{}, fmt.Errorf("waiting for pin %s: %w", status.RequestId, ctx.Err())
+		case <-deadline.C:
+			return Receipt{}, fmt.Errorf("pin %s still %q after %s", status.RequestId, status.Status, p.timeout)
+		case <-t.C:
+		}
+		status, err = p.do(ctx, "GET", p.endpoint+"/"+url.PathEscape(status.RequestId), nil, http.StatusOK)
+		if err != nil {
+			return Receipt{}, err
+		}
+	}
+
+	if status.Status != "pinned" {
+		return Receipt{}, fmt.Errorf("pin %s ended with status %q, info: %v", status.RequestId, status.Status, status.Info)
+	}
+	return Receipt{Info: map[string]string{
+		"requestid": status.RequestId,
+		"status":    status.Status,
+	}}, nil
+}
+
+func (p *pinningDriver) do(ctx context.Context, method, endpoint string, body []byte, expected int) (pinningStatus, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, r)
+	if err != nil {
+		return pinningStatus{}, fmt.Errorf("creating the request failed: %w", err)
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Authorization", "Bearer "+p.key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return pinningStatus{}, fmt.Errorf("%s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != expected {
+		return pinningStatus{}, fmt.Errorf("non %d result code: %d / body: %s", expected, resp.StatusCode, string(b))
+	}
+	if err != nil {
+		return pinningStatus{}, fmt.Errorf("reading response: %w", err)
+	}
+
+	var status pinningStatus
+	err = json.Unmarshal(b, &status)
+	if err != nil {
+		return pinningStatus{}, fmt.Errorf("decoding response %q: %w", string(b), err)
+	}
+	return status, nil
+}
+
+func (*pinningDriver) Close() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakePinning accepts pins of root and reports them as final once polled.
+func fakePinning(root, final string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			http.Error(w, "bad key", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/pins":
+			var pin struct {
+				Cid string `json:"cid"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&pin)
+			if err != nil || pin.Cid != root {
+				http.Error(w, "unexpected pin", http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, `{"requestid":"r1","status":"queued","pin":{"cid":%q}}`, root)
+		case r.Method == "GET" && r.URL.Path == "/pins/r1":
+			fmt.Fprintf(w, `{"requestid":"r1","status":%q,"pin":{"cid":%q}}`, final, root)
+		default:
+			http.Error(w, "unexpected request", http.StatusNotFound)
+		}
+	})
+}
+
+func TestPinningCar(t *testing.T) {
+	payload := newTestPayload(t, []byte("header"), []byte("body"))
+	for _, tc := range []struct {
+		final string
+		cars  int
+	}{
+		{final: "pinned", cars: 1},
+		{final: "failed", cars: 0},
+	} {
+		t.Run(tc.final, func(t *testing.T) {
+			srv := httptest.NewServer(fakePinning(payload.Root.String(), tc.final))
+			defer srv.Close()
+			t.Setenv(envPinningEndpointKey, srv.URL)
+			t.Setenv(envPinningKeyKey, "key")
+
+			dir := t.TempDir()
+			d, err := newPinningDriver("car=" + filepath.Join(dir, "out.%d.car") + ",poll=1ms")
+			if err != nil {
+				t.Fatal(err)
+			}
+			receipt, err := d.Send(context.Background(), payload)
+			if (err == nil) != (tc.final == "pinned") {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err == nil && receipt.Info["car"] == "" {
+				t.Errorf("car missing from the receipt %v", receipt.Info)
+			}
+			cars, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cars) != tc.cars {
+				t.Errorf("expected %d cars left, found %d", tc.cars, len(cars))
+			}
+		})
+	}
+}
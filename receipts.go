@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// appendReceipt adds one JSON encoded receipt per line at the end of path.
+func appendReceipt(path string, receipt Receipt) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("openning %s: %w", path, err)
+	}
+	defer f.Close()
+
+	err = json.NewEncoder(f).Encode(receipt)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", path, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("closing %s: %w", path, err)
+	}
+	return nil
+}
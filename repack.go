@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	pb "github.com/Jorropo/linux2ipfs/pb"
+	"github.com/ipfs/go-cid"
+	"google.golang.org/protobuf/proto"
+)
+
+const repackHelp = `Repack:
+  ` + "%[1]s" + ` repack [flags] <car path>...
+  Copies the blocks of CARv1 and CARv2 files to the temp cars and sends them
+  to the drivers like a run does, split to car-size and linked by fake roots.
+  Blocks of at least 4096 bytes are padded so their data is aligned and
+  copy_file_range reflinks them from input cars on the filesystem of the temp
+  cars. Duplicate blocks and padding blocks nothing links are dropped, the
+  fake roots of the input cars are copied like other blocks since they can't
+  be told apart from real directories. The run flags apply but include,
+  exclude and self-contained, the incremental file isn't updated but the
+  receipts are appended next to it.
+
+`
+
+// repackBlock is a block of the input cars, offset locates its data in car.
+type repackBlock struct {
+	car    *os.File
+	cid    cid.Cid
+	offset int64
+	length int64
+	pad    bool
+}
+
+type repacker struct {
+	// blocks are the first copy of each block in the order of the cars.
+	blocks []repackBlock
+	seen   map[string]struct{}
+	// linked are the hashes linked by dag-pb blocks or the header roots.
+	linked map[string]struct{}
+	buf    []byte
+
+	duplicates, padding int
+}
+
+func repackCommand(args []string) int {
+	o, ok := parseRunOptions(args, true)
+	if !ok {
+		return 1
+	}
+
+	p := repacker{seen: map[string]struct{}{}, linked: map[string]struct{}{}}
+	for _, path := range o.cars {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error opening car: "+err.Error())
+			return 1
+		}
+		defer f.Close()
+		err = p.indexCar(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading "+path+": "+err.Error())
+			return 1
+		}
+	}
+
+	return runPipeline(o, false, func(r *recursiveTraverser) int {
+		// Cars are sized for the route fitting everything left to repack.
+		var remaining int64
+		for _, b := range p.blocks {
+			remaining += b.length + r.blockOverhead()
+		}
+		var n int
+		for _, b := range p.blocks {
+			r.expectWork(remaining)
+			remaining -= b.length + r.blockOverhead()
+			if _, ok := p.linked[string(b.cid.Hash())]; b.pad && !ok {
+				p.padding++
+				continue
+			}
+			err := p.add(r, b)
+			if err != nil {
+				if !errors.Is(err, errClosing) {
+					fmt.Fprintln(os.Stderr, "error repacking: "+err.Error())
+				}
+				return 1
+			}
+			n++
+		}
+		err := r.flush()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error making last swap: "+err.Error())
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "repacked %d blocks of %d cars into %d cars, dropped %d duplicate and %d padding blocks\n", n, len(o.cars), r.carCounter, p.duplicates, p.padding)
+		return 0
+	})
+}
+
+// indexCar adds the blocks of f to p and records what they link.
+func (p *repacker) indexCar(f *os.File) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	layout, err := readCarLayout(f, st.Size())
+	if err != nil {
+		return err
+	}
+	data := io.NewSectionReader(f, layout.DataOffset, layout.DataSize)
+	header, off, err := readCarHeader(data)
+	if err != nil {
+		return err
+	}
+	for _, root := range header.Roots {
+		p.linked[string(root.Hash())] = struct{}{}
+	}
+	return readCarBlocks(data, off, layout.DataSize, func(b carBlock) error {
+		k := string(b.Cid.Hash())
+		if _, ok := p.seen[k]; ok {
+			p.duplicates++
+			return nil
+		}
+		p.seen[k] = struct{}{}
+		p.blocks = append(p.blocks, repackBlock{f, b.Cid, layout.DataOffset + b.Offset, b.Length, isPadBlock(b)})
+		if b.Cid.Type() != cid.DagProtobuf {
+			return nil
+		}
+
+		if int64(cap(p.buf)) < b.Length {
+			p.buf = make([]byte, b.Length)
+		}
+		buf := p.buf[:b.Length]
+		_, err := data.ReadAt(buf, b.Offset)
+		if err != nil {
+			return fmt.Errorf("reading block %s: %w", b.Cid, err)
+		}
+		var n pb.PBNode
+		if proto.Unmarshal(buf, &n) != nil {
+			// It is copied as is, verify reports it.
+			return nil
+		}
+		for _, l := range n.Links {
+			lc, err := cid.Cast(l.Hash)
+			if err == nil {
+				p.linked[string(lc.Hash())] = struct{}{}
+			}
+		}
+		return nil
+	})
+}
+
+// add copies b to the temp car and queues it to be linked by the fake roots.
+func (p *repacker) add(r *recursiveTraverser, b repackBlock) error {
+	select {
+	case <-r.cancel:
+		return errClosing
+	default:
+	}
+
+	header := sectionHeader(b.cid, b.length)
+	size := int64(len(header)) + b.length
+	toPad := repackPadding(r.tempCarOffset, b.length)
+	off, needSwap := r.mayTakeOffset(size + toPad)
+	if needSwap {
+		err := r.swap()
+		if err != nil {
+			return fmt.Errorf("swapping: %w", err)
+		}
+		toPad = repackPadding(r.tempCarOffset, b.length)
+		off, needSwap = r.mayTakeOffset(size + toPad)
+		if needSwap {
+			return fmt.Errorf("block %s of %d bytes doesn't fit in a car", b.cid, b.length)
+		}
+	}
+
+	_, err := r.tempCarChunk.WriteAt(header, off)
+	if err != nil {
+		return fmt.Errorf("writing CID + header: %w", err)
+	}
+	err = copyFileRange(r.tempCarChunk, off+int64(len(header)), b.car, b.offset, b.length)
+	if err != nil {
+		return fmt.Errorf("copying block %s to back buffer: %w", b.cid, err)
+	}
+	if toPad != 0 {
+		_, err = r.tempCarChunk.WriteAt(createPadBlockHeader(uint16(toPad)), off+size)
+		if err != nil {
+			return fmt.Errorf("writing padding: %w", err)
+		}
+	}
+	r.addToSend(&cidSizePair{
+		Cid:      b.cid,
+		FileSize: b.length,
+		DagSize:  b.length,
+		Offset:   off,
+		Length:   size,
+		Padding:  toPad,
+	})
+	return nil
+}
+
+// repackPadding returns the padding to write after a block of length bytes
+// ending at tempCarOffset so its data is aligned, like the chunker does.
+func repackPadding(tempCarOffset, length int64) int64 {
+	if noPad || length < diskAssumedBlockSize {
+		return 0
+	}
+	toPad := (tempCarOffset%diskAssumedBlockSize + diskAssumedBlockSize - length%diskAssumedBlockSize) % diskAssumedBlockSize
+	if toPad != 0 && toPad < fakeBlockMinLength {
+		// we can't pad so little, pad to the next size
+		toPad += diskAssumedBlockSize
+	}
+	return toPad
+}
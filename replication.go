@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stringList is a flag which can be repeated.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// namedDriver is one of the drivers a run sends cars to, each keeps its own
+// retries and failed outs.
+type namedDriver struct {
+	driver
+	name string
+
+	failedOut        carDriver
+	failedOutDir     string
+	makeFailedOutDir sync.Once
+
+	// accessed atomically
+	sent           uint64
+	failedAttempts uint64
+	failedOuts     uint64
+}
+
+// newNamedDriver creates a driver from a <name>[-<params>] selector and
+// returns it with its maximum car size.
+func newNamedDriver(driverTarget string) (*namedDriver, int64, error) {
+	name, params, _ := strings.Cut(driverTarget, "-")
+	driv, ok := drivers[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("driver: %q not found", driverTarget)
+	}
+	d, err := driv.factory(params)
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating driver: %w", err)
+	}
+	return &namedDriver{driver: d, name: name}, driv.maxCarSize, nil
+}
+
+// nameDrivers gives each driver a unique name and its failed-outs directory,
+// it must be called once flags are validated.
+func nameDrivers(ds []*namedDriver) {
+	count := map[string]int{}
+	for _, d := range ds {
+		count[d.name]++
+	}
+	for i, d := range ds {
+		if count[d.name] > 1 {
+			d.name += "." + strconv.Itoa(i+1)
+		}
+		d.failedOutDir = uploadFailedOut
+		if len(ds) > 1 {
+			d.failedOutDir += "/" + d.name
+		}
+		d.failedOut = carDriver{pathFormat: d.failedOutDir + "/%d.car"}
+	}
+}
+
+// replicationPolicy tells how many drivers must succeed for a car to be sent.
+type replicationPolicy struct {
+	min int
+	// fallback tries the drivers in order and stops at the first success.
+	fallback bool
+}
+
+func parseReplicationPolicy(s string, driverCount int) (replicationPolicy, error) {
+	switch s {
+	case "all":
+		return replicationPolicy{min: driverCount}, nil
+	case "fallback":
+		return replicationPolicy{min: 1, fallback: true}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return replicationPolicy{}, fmt.Errorf("expected \"all\", \"fallback\" or a number, got %q", s)
+	}
+	if n < 1 || n > driverCount {
+		return replicationPolicy{}, fmt.Errorf("%d isn't between 1 and the number of drivers (%d)", n, driverCount)
+	}
+	return replicationPolicy{min: n}, nil
+}
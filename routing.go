@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// route sends cars up to maxSize bytes (header included) to a driver.
+type route struct {
+	maxSize int64
+	d       *namedDriver
+}
+
+// parseRoute splits a route selector, <size>:<driver> or just <driver> for
+// a catch-all route, a catch-all route has a zero size.
+func parseRoute(s string) (int64, string, error) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		// Drivers names never start with a digit.
+		return 0, s, nil
+	}
+	sizeStr, driverTarget, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, "", fmt.Errorf("expected <size>:<driver>, got %q", s)
+	}
+	size, err := parseSize(sizeStr)
+	if err != nil {
+		return 0, "", err
+	}
+	if size == 0 {
+		return 0, "", fmt.Errorf("zero sized route %q", s)
+	}
+	return size, driverTarget, nil
+}
+
+// parseSize parses a number of bytes with an optional SI (KB, MB, ...) or
+// IEC (KiB, MiB, ...) unit.
+func parseSize(s string) (int64, error) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing size %q: %w", s, err)
+	}
+
+	unit := strings.TrimSuffix(strings.TrimSpace(s[i:]), "B")
+	var base int64 = 1000
+	if strings.HasSuffix(unit, "i") {
+		base = 1024
+		unit = unit[:len(unit)-1]
+	}
+	var exp int
+	switch strings.ToUpper(unit) {
+	case "":
+		if base == 1024 {
+			return 0, fmt.Errorf("unknown size unit in %q", s)
+		}
+	case "K":
+		exp = 1
+	case "M":
+		exp = 2
+	case "G":
+		exp = 3
+	case "T":
+		exp = 4
+	default:
+		return 0, fmt.Errorf("unknown size unit in %q", s)
+	}
+	for ; exp != 0; exp-- {
+		if n > math.MaxInt64/base {
+			return 0, fmt.Errorf("size %q overflows", s)
+		}
+		n *= base
+	}
+	return n, nil
+}
+
+// fakeRootsLinkEstimate is an upper bound of how many bytes each block adds
+// to the fakeroots (a link is about 55 bytes, plus the share of the fakeroot
+// blocks headers).
+const fakeRootsLinkEstimate = 64
+
+// carHeaderEstimate is an upper bound of the size of the CAR header.
+const carHeaderEstimate = 128
+
+// overLimit reports if adding a block of size bytes would make the car,
+// once the fakeroots and the header are added, bigger than its limit.
+func (r *recursiveTraverser) overLimit(size int64) bool {
+	return r.overLimitBlocks(size, 1)
+}
+
+// overLimitBlocks is overLimit for size bytes spread over blocks blocks.
+func (r *recursiveTraverser) overLimitBlocks(size, blocks int64) bool {
+	if r.carLimit == 0 {
+		return false
+	}
+	used := carMaxSize - r.tempCarOffset + size
+	return used+(r.carBlocks+blocks)*r.blockOverhead()+carHeaderEstimate > r.carLimit
+}
+
+// limitFor returns the limit of a car started for work bytes, the first
+// route fitting them or the last one, capped to the sector with -fit-sector.
+// It is 0 if cars are only limited by car-size.
+func (r *recursiveTraverser) limitFor(work int64) int64 {
+	var limit int64
+	if len(r.routes) != 0 {
+		limit = r.routes[len(r.routes)-1].maxSize
+		for _, rt := range r.routes {
+			if work+carHeaderEstimate <= rt.maxSize {
+				limit = rt.maxSize
+				break
+			}
+		}
+	}
+	if r.sectorFit != 0 {
+		if l := r.sectorFit - sectorReserve; limit == 0 || l < limit {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// expectWork records that work bytes are about to be written, the current
+// car is resized for them if it is still empty.
+func (r *recursiveTraverser) expectWork(work int64) {
+	r.pending = work
+	if r.tempCarOffset == carMaxSize {
+		r.carLimit = r.limitFor(work)
+	}
+}
+
+// expectFile is expectWork for the blocks of a file of size bytes.
+func (r *recursiveTraverser) expectFile(size int64) {
+	est, blocks := fileCarEstimate(size)
+	r.expectWork(est + blocks*r.blockOverhead())
+}
+
+// route returns the drivers a payload of size bytes must be sent to and
+// with which policy.
+func (r *recursiveTraverser) route(size int64) ([]*namedDriver, replicationPolicy) {
+	if len(r.routes) == 0 {
+		return r.drivers, r.replication
+	}
+	d := r.routes[len(r.routes)-1].d
+	for _, rt := range r.routes {
+		if size <= rt.maxSize {
+			d = rt.d
+			break
+		}
+	}
+	return []*namedDriver{d}, replicationPolicy{min: 1}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envS3AccessKeyKey    = "AWS_ACCESS_KEY_ID"
+	envS3SecretKeyKey    = "AWS_SECRET_ACCESS_KEY"
+	envS3SessionTokenKey = "AWS_SESSION_TOKEN"
+
+	defaultS3Region   = "us-east-1"
+	defaultS3Key      = "{root}.car"
+	defaultS3PartSize = 1024 * 1024 * 64 // 64MiB
+	s3MinPartSize     = 1024 * 1024 * 5  // 5MiB
+	s3MaxParts        = 10000
+	// s3AbortTimeout bounds aborting a failed upload, the upload context may
+	// already be cancelled.
+	s3AbortTimeout = time.Minute
+
+	emptySha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var s3DriverCreator = driverCreator{
+	factory:    newS3Driver,
+	help:       s3Help,
+	maxCarSize: 1 << 42,
+}
+
+func s3Help(out io.Writer) {
+	fmt.Fprint(out, `  Environ:
+  - `+envS3AccessKeyKey+` access key (secret)
+  - `+envS3SecretKeyKey+` secret key (secret)
+  - `+envS3SessionTokenKey+` optional session token (secret)
+  Positional:
+  - <BUCKET> REQUIRED
+  Options:
+  - endpoint=<URL> a path is kept as a prefix for reverse proxies, defaults to
+    "https://s3.<region>.amazonaws.com"
+  - region=<REGION> defaults to "`+defaultS3Region+`"
+  - key=<TEMPLATE> object key, {root} and {n} are replaced by the car root and number, defaults to "`+defaultS3Key+`"
+  - part-size=<bytes> multipart upload part size, defaults to `+strconv.Itoa(defaultS3PartSize)+`
+  - path-style=<bool> use path style instead of virtual hosted style urls, defaults to true
+
+`)
+}
+
+func newS3Driver(input string) (driver, error) {
+	bucket, opts, err := parseDriverParams(input)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("empty s3 bucket")
+	}
+
+	d := &s3Driver{
+		region:      opts.take("region", defaultS3Region),
+		keyTemplate: opts.take("key", defaultS3Key),
+		partSize:    defaultS3PartSize,
+		client:      newHTTPClient(),
+	}
+	d.accessKey, err = getSecret(envS3AccessKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	d.secretKey, err = getSecret(envS3SecretKeyKey)
+	if err != nil {
+		return nil, err
+	}
+	d.sessionToken, err = getSecret(envS3SessionTokenKey)
+	if err != nil {
+		return nil, err
+	}
+	if d.accessKey == "" {
+		return nil, fmt.Errorf("error empty " + envS3AccessKeyKey + " envKey")
+	}
+	if d.secretKey == "" {
+		return nil, fmt.Errorf("error empty " + envS3SecretKeyKey + " envKey")
+	}
+
+	if partSize := opts.take("part-size", ""); partSize != "" {
+		d.partSize, err = strconv.ParseInt(partSize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("option part-size: %w", err)
+		}
+		if d.partSize < s3MinPartSize {
+			return nil, fmt.Errorf("option part-size cannot be smaller than %d", s3MinPartSize)
+		}
+	}
+	pathStyle, err := opts.takeBool("path-style", true)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := url.Parse(opts.take("endpoint", "https://s3."+d.region+".amazonaws.com"))
+	if err != nil {
+		return nil, fmt.Errorf("option endpoint: %w", err)
+	}
+	err = opts.done()
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.RawQuery != "" || endpoint.Fragment != "" {
+		return nil, fmt.Errorf("option endpoint cannot have a query or fragment")
+	}
+	prefix := strings.TrimSuffix(endpoint.EscapedPath(), "/")
+	if pathStyle {
+		d.base = endpoint.Scheme + "://" + endpoint.Host + prefix + "/" + s3Escape(bucket, true)
+	} else {
+		d.base = endpoint.Scheme + "://" + bucket + "." + endpoint.Host + prefix
+	}
+	d.bucket = bucket
+	return d, nil
+}
+
+type s3Driver struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+
+	base        string
+	bucket      string
+	keyTemplate string
+	partSize    int64
+
+	client *http.Client
+}
+
+type s3CompletedPart struct {
+	PartNumber     int
+	ETag           string
+	ChecksumSHA256 string
+}
+
+func (s *s3Driver) Send(ctx context.Context, payload CarPayload) (Receipt, error) {
+	key := expandCarTemplate(s.keyTemplate, payload)
+	object := s.base + "/" + s3Escape(key, true)
+
+	resp, err := s.do(ctx, "POST", object+"?uploads", nil, 0, emptySha256, http.Header{
+		"Content-Type":             {"application/vnd.ipld.car"},
+		"X-Amz-Checksum-Algorithm": {"SHA256"},
+		"X-Amz-Meta-Root":          {payload.Root.String()},
+	})
+	if err != nil {
+		return Receipt{}, fmt.Errorf("creating multipart upload: %w", err)
+	}
+	var create struct {
+		UploadId string
+	}
+	err = xml.Unmarshal(resp, &create)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("decoding create multipart upload result: %w", err)
+	}
+	uploadQuery := "uploadId=" + url.QueryEscape(create.UploadId)
+
+	receipt, err := s.sendParts(ctx, payload, object, uploadQuery)
+	if err != nil {
+		// Don't let the parts already uploaded linger.
+		actx, cancel := context.WithTimeout(context.Background(), s3AbortTimeout)
+		_, aerr := s.do(actx, "DELETE", object+"?"+uploadQuery, nil, 0, emptySha256, nil)
+		cancel()
+		if aerr != nil {
+			err = fmt.Errorf("%w; also failed to abort: %v", err, aerr)
+		}
+		return Receipt{}, err
+	}
+	receipt.Info["bucket"] = s.bucket
+	receipt.Info["key"] = key
+	receipt.Info["uploadId"] = create.UploadId
+	return receipt, nil
+}
+
+func (s *s3Driver) sendParts(ctx context.Context, payload CarPayload, object, uploadQuery string) (Receipt, error) {
+	partSize := s.partSize
+	if min := (payload.Size-1)/s3MaxParts + 1; partSize < min {
+		partSize = min
+	}
+
+	var parts []s3CompletedPart
+	for off := int64(0); off < payload.Size; off += partSize {
+		size := partSize
+		if remaining := payload.Size - off; remaining < size {
+			size = remaining
+		}
+		// Hash the part first, this reads it twice from the temp file but saves
+		// copying it anywhere.
+		h := sha256.New()
+		_, err := io.Copy(h, io.NewSectionReader(payload, off, size))
+		if err != nil {
+			return Receipt{}, fmt.Errorf("hashing part: %w", err)
+		}
+		sum := h.Sum(nil)
+		checksum := base64.StdEncoding.EncodeToString(sum)
+
+		partNumber := len(parts) + 1
+		req, err := s.newRequest(ctx, "PUT", object+"?partNumber="+strconv.Itoa(partNumber)+"&"+uploadQuery, newUploadReader(ctx, io.NewSectionReader(payload, off, size)), size, hex.EncodeToString(sum), http.Header{
+			"X-Amz-Checksum-Sha256": {checksum},
+		})
+		if err != nil {
+			return Receipt{}, err
+		}
+		r, err := s.client.Do(req)
+		if err != nil {
+			return Receipt{}, fmt.Errorf("uploading part %d: %w", partNumber, err)
+		}
+		b, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		if r.StatusCode != 200 {
+			return Receipt{}, fmt.Errorf("uploading part %d non 200 result code: %d / body: %s", partNumber, r.StatusCode, string(b))
+		}
+		parts = append(parts, s3CompletedPart{partNumber, r.Header.Get("ETag"), checksum})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return Receipt{}, fmt.Errorf("encoding complete multipart upload: %w", err)
+	}
+	bodySum := sha256.Sum256(body)
+	resp, err := s.do(ctx, "POST", object+"?"+uploadQuery, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(bodySum[:]), http.Header{
+		"Content-Type": {"application/xml"},
+	})
+	if err != nil {
+		return Receipt{}, fmt.Errorf("completing multipart upload: %w", err)
+	}
+	// S3 can report errors with a 200 status code once it started answering.
+	var complete struct {
+		XMLName        xml.Name
+		ETag           string
+		ChecksumSHA256 string
+		Message        string
+	}
+	err = xml.Unmarshal(resp, &complete)
+	if err != nil {
+		return Receipt{}, fmt.Errorf("decoding complete multipart upload result: %w", err)
+	}
+	if complete.XMLName.Local != "CompleteMultipartUploadResult" {
+		return Receipt{}, fmt.Errorf("completing multipart upload: %s: %s", complete.XMLName.Local, complete.Message)
+	}
+
+	return Receipt{Info: map[string]string{
+		"etag":           complete.ETag,
+		"checksumSha256": complete.ChecksumSHA256,
+	}}, nil
+}
+
+// do sends a request and returns the body of a successful response.
+func (s *s3Driver) do(ctx context.Context, method, endpoint string, body io.Reader, size int64, bodySha256 string, headers http.Header) ([]byte, error) {
+	req, err := s.newRequest(ctx, method, endpoint, body, size, bodySha256, headers)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", method, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("non 2xx result code: %d / body: %s", resp.StatusCode, string(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	return b, nil
+}
+
+// newRequest creates a request signed with AWS signature version 4.
+func (s *s3Driver) newRequest(ctx context.Context, method, endpoint string, body io.Reader, size int64, bodySha256 string, headers http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("creating the request failed: %w", err)
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Amz-Content-Sha256", bodySha256)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	signV4(req, s.accessKey, s.secretKey, s.region, "s3", bodySha256, time.Now())
+	// Set after signing, proxies are free to change it.
+	req.Header.Set("User-Agent", userAgent)
+	return req, nil
+}
+
+// signV4 signs req with AWS signature version 4, the host and every header
+// already set on req are signed. payloadHash is the hex sha256 of the body.
+func signV4(req *http.Request, accessKey, secretKey, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signed := []string{"host"}
+	for k := range req.Header {
+		signed = append(signed, strings.ToLower(k))
+	}
+	sort.Strings(signed)
+	var canonicalHeaders string
+	for _, k := range signed {
+		v := req.URL.Host
+		if k != "host" {
+			v = strings.TrimSpace(strings.Join(req.Header.Values(k), ","))
+		}
+		canonicalHeaders += k + ":" + v + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, v := range []string{date, region, service, "aws4_request"} {
+		key = hmacSha256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent encodes everything but unreserved characters (and '/' if
+// keepSlash is true) as required by AWS signatures.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || keepSlash && c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func (*s3Driver) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const (
+	secretFileSuffix    = "_FILE"
+	secretCommandSuffix = "_COMMAND"
+	envCredentialsDir   = "CREDENTIALS_DIRECTORY"
+
+	// minRedactedLength avoids mangling messages with tiny secrets.
+	minRedactedLength = 4
+	redacted          = "<redacted>"
+)
+
+var secretsHelp = `Secrets:
+  Envs marked as secrets can also be read from the file in <ENV>` + secretFileSuffix + `,
+  from the systemd credential named <ENV> (in $` + envCredentialsDir + `)
+  or from the stdout of the "sh -c" command in <ENV>` + secretCommandSuffix + `,
+  their values are redacted from errors.
+
+`
+
+// getSecret returns the secret named name, it tries the env, a file, a
+// systemd credential and a command in this order, an empty string is
+// returned if none are set.
+func getSecret(name string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		registerSecret(v)
+		return v, nil
+	}
+
+	var v []byte
+	var err error
+	if path := os.Getenv(name + secretFileSuffix); path != "" {
+		v, err = os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading %s: %w", name+secretFileSuffix, err)
+		}
+	} else if dir := os.Getenv(envCredentialsDir); dir != "" {
+		v, err = os.ReadFile(dir + "/" + name)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("reading %s credential: %w", name, err)
+		}
+	}
+	if v == nil {
+		if command := os.Getenv(name + secretCommandSuffix); command != "" {
+			if validateOnly {
+				// Only check a secret is configured.
+				return "<" + name + secretCommandSuffix + ">", nil
+			}
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Stderr = os.Stderr
+			v, err = cmd.Output()
+			if err != nil {
+				return "", fmt.Errorf("running %s: %w", name+secretCommandSuffix, err)
+			}
+		}
+	}
+
+	s := string(bytes.TrimRight(v, "\r\n"))
+	registerSecret(s)
+	return s, nil
+}
+
+var secretsLk sync.Mutex
+var secretsRedactor = strings.NewReplacer()
+var secrets []string
+
+// registerSecret makes redact hide s.
+func registerSecret(s string) {
+	if len(s) < minRedactedLength {
+		return
+	}
+	secretsLk.Lock()
+	defer secretsLk.Unlock()
+	secrets = append(secrets, s, redacted)
+	secretsRedactor = strings.NewReplacer(secrets...)
+}
+
+// redact hides the known secrets in s, use it on errors before printing
+// them, drivers may echo back what they send.
+func redact(s string) string {
+	secretsLk.Lock()
+	r := secretsRedactor
+	secretsLk.Unlock()
+	return r.Replace(s)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// sectorReserve is kept free in cars fitted to a sector for what drivers add
+// around the payload, the car driver's pad block after the header and the
+// CARv2 header and index header.
+const sectorReserve = 3 * diskAssumedBlockSize
+
+// carV2IndexRecordEstimate is how many bytes each block adds to a CARv2
+// index, fitted cars assume they may get one.
+const carV2IndexRecordEstimate = 40
+
+// parseSectorSize returns the maximum unpadded size of a piece filling a
+// sector of the given size.
+func parseSectorSize(s string) (int64, error) {
+	size, err := parseSize(s)
+	if err != nil {
+		return 0, err
+	}
+	if size < diskAssumedBlockSize*fr32PaddedChunk || size&(size-1) != 0 {
+		return 0, fmt.Errorf("sector size %d must be a power of two of at least %d", size, diskAssumedBlockSize*fr32PaddedChunk)
+	}
+	return size / fr32PaddedChunk * fr32UnpaddedChunk, nil
+}
+
+// blockOverhead is how many bytes each block adds outside of the temp car.
+func (r *recursiveTraverser) blockOverhead() int64 {
+	if r.sectorFit != 0 {
+		return fakeRootsLinkEstimate + carV2IndexRecordEstimate
+	}
+	return fakeRootsLinkEstimate
+}
+
+// checkSectorFit warns if the estimates were wrong and payload, once the
+// drivers added their overhead, may not fit the sector anymore.
+func (r *recursiveTraverser) checkSectorFit(payload CarPayload) {
+	if r.sectorFit == 0 {
+		return
+	}
+	size := payload.Size + sectorReserve + int64(len(payload.Index))*carV2IndexRecordEstimate
+	if size <= r.sectorFit {
+		return
+	}
+	talkLock.Lock()
+	fmt.Fprintf(os.Stderr, "warning car %d (%s) may be up to %d bytes, over the %d bytes a sector fits\n", payload.Seq, payload.Root, size, r.sectorFit)
+	talkLock.Unlock()
+}
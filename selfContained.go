@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// carSet are the cars holding some blocks, cars of this run are known by
+// seq, their roots only exist once their payload is made, cars of previous
+// runs by root.
+type carSet struct {
+	seqs  map[uint64]struct{}
+	roots map[string]struct{}
+}
+
+func (s *carSet) addSeq(seq uint64) {
+	if s.seqs == nil {
+		s.seqs = map[uint64]struct{}{}
+	}
+	s.seqs[seq] = struct{}{}
+}
+
+func (s *carSet) addRoots(roots []string) {
+	if len(roots) == 0 {
+		return
+	}
+	if s.roots == nil {
+		s.roots = map[string]struct{}{}
+	}
+	for _, r := range roots {
+		s.roots[r] = struct{}{}
+	}
+}
+
+func (s *carSet) addSet(o carSet) {
+	for seq := range o.seqs {
+		s.addSeq(seq)
+	}
+	if s.roots == nil && len(o.roots) != 0 {
+		s.roots = make(map[string]struct{}, len(o.roots))
+	}
+	for r := range o.roots {
+		s.roots[r] = struct{}{}
+	}
+}
+
+// sortedSeqs returns the seqs in order.
+func (s carSet) sortedSeqs() []uint64 {
+	seqs := make([]uint64, 0, len(s.seqs))
+	for seq := range s.seqs {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// resolve returns the roots of the cars, waiting for the cars of this run.
+func (s carSet) resolve(roots *carRoots) []string {
+	r := make([]string, 0, len(s.seqs)+len(s.roots))
+	for _, seq := range s.sortedSeqs() {
+		r = append(r, roots.wait(seq).String())
+	}
+	for root := range s.roots {
+		r = append(r, root)
+	}
+	sort.Strings(r[len(s.seqs):])
+	return r
+}
+
+// carRoots remembers the root of each car of this run once its payload is
+// made.
+type carRoots struct {
+	lock  sync.Mutex
+	cond  sync.Cond
+	roots map[uint64]cid.Cid
+}
+
+func newCarRoots() *carRoots {
+	c := &carRoots{roots: map[uint64]cid.Cid{}}
+	c.cond.L = &c.lock
+	return c
+}
+
+func (c *carRoots) set(seq uint64, root cid.Cid) {
+	c.lock.Lock()
+	c.roots[seq] = root
+	c.lock.Unlock()
+	c.cond.Broadcast()
+}
+
+// wait returns the root of the car seq, cars are made in order by the send
+// workers so this only waits for the ones still being made.
+func (c *carRoots) wait(seq uint64) cid.Cid {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		root, ok := c.roots[seq]
+		if ok {
+			return root
+		}
+		c.cond.Wait()
+	}
+}
+
+// addToSend queues blocks written to the current car.
+func (r *recursiveTraverser) addToSend(blocks ...*cidSizePair) {
+	if r.selfContained {
+		for _, b := range blocks {
+			b.Car = r.carCounter
+			b.Block = b
+		}
+	}
+	r.toSend = append(r.toSend, blocks...)
+}
+
+// trackDAG records that block is the node c linking children and returns
+// the pair to link it with, children in the same car are marked linked.
+func (r *recursiveTraverser) trackDAG(block *cidSizePair, c cid.Cid, fileSize, dagSize int64, children []*cidSizePair) *cidSizePair {
+	p := &cidSizePair{Cid: c, FileSize: fileSize, DagSize: dagSize}
+	if !r.selfContained {
+		return p
+	}
+	block.Link = c
+	block.DagSize = dagSize
+	for _, child := range children {
+		block.Deps.addSet(child.Deps)
+		if child.Block == nil {
+			continue
+		}
+		if child.Block.Car == block.Car {
+			child.Block.Linked = true
+		} else {
+			block.Deps.addSeq(child.Block.Car)
+		}
+	}
+	p.Block = block
+	p.Deps = block.Deps
+	return p
+}
+
+// reused returns the pair of a DAG added by a previous run.
+func (r *recursiveTraverser) reused(c cid.Cid, fileSize, dagSize int64, old *savedCidsPairs) *cidSizePair {
+	p := &cidSizePair{Cid: c, FileSize: fileSize, DagSize: dagSize}
+	if r.selfContained {
+		p.Deps.addRoots(old.Cars)
+	}
+	return p
+}
+
+// savedCars fills s with the cars holding the DAG of c.
+func (r *recursiveTraverser) savedCars(s *savedCidsPairs, c *cidSizePair) {
+	if !r.selfContained {
+		return
+	}
+	var cars carSet
+	cars.addSet(c.Deps)
+	if c.Block != nil {
+		cars.addSeq(c.Block.Car)
+	}
+	s.carSeqs = cars.sortedSeqs()
+	for root := range cars.roots {
+		s.Cars = append(s.Cars, root)
+	}
+	sort.Strings(s.Cars)
+}
+
+// resolveSavedCars replaces the entries of cids still referencing cars of
+// this run by seq with ones listing their roots, the entries may be shared
+// with other snapshots so they are not modified.
+func resolveSavedCars(cids map[string]*savedCidsPairs, roots *carRoots) {
+	for k, v := range cids {
+		if len(v.carSeqs) == 0 {
+			continue
+		}
+		n := *v
+		var cars carSet
+		cars.addRoots(v.Cars)
+		for _, seq := range v.carSeqs {
+			cars.addSeq(seq)
+		}
+		n.Cars = cars.resolve(roots)
+		n.carSeqs = nil
+		cids[k] = &n
+	}
+}
+
+// fileCarEstimate is an upper bound of the bytes and blocks a file of size
+// bytes uses in a car.
+func fileCarEstimate(size int64) (int64, int64) {
+	leaves := (size-1)/blockTarget + 1
+	perLeaf := int64(binary.MaxVarintLen64 + rawleafCIDLength + diskAssumedBlockSize + fakeBlockMinLength)
+	// The roots have at most one link per leaf per level and there are less
+	// nodes than leaves.
+	roots := leaves * 2 * fakeRootsLinkEstimate
+	return size + leaves*perLeaf + roots, leaves * 2
+}
+
+// makeRoomForFile swaps to a new car if the file doesn't fit in the current
+// one but fits in an empty one, it reports if it swapped.
+func (r *recursiveTraverser) makeRoomForFile(size int64) (bool, error) {
+	if !r.selfContained || r.tempCarOffset == carMaxSize {
+		return false, nil
+	}
+	est, blocks := fileCarEstimate(size)
+	if est <= r.tempCarOffset && !r.overLimitBlocks(est, blocks) {
+		return false, nil
+	}
+	total := est + blocks*r.blockOverhead()
+	if limit := r.limitFor(total); est > carMaxSize || (limit != 0 && total+carHeaderEstimate > limit) {
+		// It will be split anyway.
+		return false, nil
+	}
+	err := r.swap()
+	if err != nil {
+		return false, fmt.Errorf("swapping: %w", err)
+	}
+	return true, nil
+}
+
+// selfContainedRoots returns the blocks of the car no other block of the car
+// links, they are the complete DAGs the fake root links, and the roots of
+// the cars holding their descendants.
+func (r *recursiveTraverser) selfContainedRoots(blocks []*cidSizePair) ([]*cidSizePair, []cid.Cid, error) {
+	var tops []*cidSizePair
+	var deps carSet
+	for _, b := range blocks {
+		if b.Linked {
+			continue
+		}
+		deps.addSet(b.Deps)
+		top := *b
+		if b.Link.Defined() {
+			top.Cid = b.Link
+		}
+		tops = append(tops, &top)
+	}
+	var roots []cid.Cid
+	for _, s := range deps.resolve(r.carRoots) {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding dependency %q: %w", s, err)
+		}
+		roots = append(roots, c)
+	}
+	return tops, roots, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadLimiter if not nil limits how fast drivers upload cars, it is shared
+// by all uploads.
+var uploadLimiter *rateLimiter
+
+type rateLimiter struct {
+	rate  int64 // bytes per second
+	chunk int
+
+	mu sync.Mutex
+	// next is when the bytes reserved so far are allowed to be sent.
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	// Wait for small chunks so we don't wait seconds at once.
+	chunk := rate / 16
+	if chunk < 512 {
+		chunk = 512
+	} else if chunk > 64*1024 {
+		chunk = 64 * 1024
+	}
+	return &rateLimiter{rate: rate, chunk: int(chunk)}
+}
+
+// wait blocks until n more bytes can be sent or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	until := l.next
+	l.mu.Unlock()
+
+	t := time.NewTimer(time.Until(until))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// uploadReader reads r within the upload limit, drivers use it for the
+// bodies they upload so local reads of the car aren't slowed down.
+type uploadReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newUploadReader(ctx context.Context, r io.Reader) io.Reader {
+	if uploadLimiter == nil {
+		return r
+	}
+	return uploadReader{ctx, r}
+}
+
+func (u uploadReader) Read(b []byte) (int, error) {
+	if len(b) > uploadLimiter.chunk {
+		b = b[:uploadLimiter.chunk]
+	}
+	err := uploadLimiter.wait(u.ctx, len(b))
+	if err != nil {
+		return 0, err
+	}
+	return u.r.Read(b)
+}
+
+// uploadWindow is a time of day range in which uploads can start, it wraps
+// around midnight if start is after end.
+type uploadWindow struct {
+	start, end time.Duration
+}
+
+func parseUploadWindow(s string) (uploadWindow, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return uploadWindow{}, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	start, err := parseTimeOfDay(startStr)
+	if err != nil {
+		return uploadWindow{}, err
+	}
+	end, err := parseTimeOfDay(endStr)
+	if err != nil {
+		return uploadWindow{}, err
+	}
+	return uploadWindow{start, end}, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("parsing time of day %q: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// untilUploadWindow returns how long to wait for one of the windows to
+// open, zero if one is already open.
+func untilUploadWindow(windows []uploadWindow, now time.Time) time.Duration {
+	if len(windows) == 0 {
+		return 0
+	}
+	y, m, d := now.Date()
+	t := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+
+	var min time.Duration = 24 * time.Hour
+	for _, w := range windows {
+		var open bool
+		switch {
+		case w.start == w.end:
+			open = true
+		case w.start < w.end:
+			open = t >= w.start && t < w.end
+		default:
+			open = t >= w.start || t < w.end
+		}
+		if open {
+			return 0
+		}
+		wait := w.start - t
+		if wait < 0 {
+			wait += 24 * time.Hour
+		}
+		if wait < min {
+			min = wait
+		}
+	}
+	return min
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	pb "github.com/Jorropo/linux2ipfs/pb"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"google.golang.org/protobuf/proto"
+)
+
+const verifyHelp = `Verify:
+  ` + "%[1]s" + ` verify [-missing-ok] <car path>...
+  Rehashes every block of CARv1 and CARv2 files, checks the padding blocks,
+  that the header roots are present, that the DAGs they link are complete
+  within each car and that no block is orphaned (not linked by a root).
+  CARv2 multihash sorted indexes are checked too.
+  -missing-ok don't fail on nor list missing blocks, cars link blocks of
+    other cars, even with -self-contained the manifest dependencies hold them.
+
+`
+
+// verifyBlock is a block of the car being verified.
+type verifyBlock struct {
+	carBlock
+	corrupt bool
+	linked  bool
+}
+
+// carVerifier accumulates the problems found in a car.
+type carVerifier struct {
+	path      string
+	missingOk bool
+	data      io.ReaderAt
+	blocks    map[string]*verifyBlock
+	// starts are the hashes of the blocks by section offset.
+	starts  map[int64]string
+	order   []*verifyBlock
+	buf     []byte
+	blocksN int
+
+	corrupt, missing, orphaned int
+}
+
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), verifyHelp, os.Args[0])
+	}
+	missingOk := flags.Bool("missing-ok", false, "")
+	if flags.Parse(args) != nil {
+		return 1
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 1
+	}
+
+	var bad bool
+	for _, p := range flags.Args() {
+		v := carVerifier{
+			path:      p,
+			missingOk: *missingOk,
+			blocks:    map[string]*verifyBlock{},
+			starts:    map[int64]string{},
+		}
+		err := v.verify()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error verifying "+p+": "+err.Error())
+			bad = true
+			continue
+		}
+		if v.corrupt != 0 || v.orphaned != 0 || (v.missing != 0 && !*missingOk) {
+			fmt.Fprintf(os.Stderr, "%s: bad, %d blocks, %d corrupt, %d missing, %d orphaned\n", p, v.blocksN, v.corrupt, v.missing, v.orphaned)
+			bad = true
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: ok, %d blocks, %d missing\n", p, v.blocksN, v.missing)
+	}
+	if bad {
+		return 1
+	}
+	return 0
+}
+
+func (v *carVerifier) problem(kind *int, format string, a ...interface{}) {
+	*kind++
+	fmt.Fprintf(os.Stderr, v.path+": "+format+"\n", a...)
+}
+
+func (v *carVerifier) verify() error {
+	f, err := os.Open(v.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	layout, err := readCarLayout(f, st.Size())
+	if err != nil {
+		return err
+	}
+	v.data = io.NewSectionReader(f, layout.DataOffset, layout.DataSize)
+	header, off, err := readCarHeader(v.data)
+	if err != nil {
+		return err
+	}
+	err = readCarBlocks(v.data, off, layout.DataSize, v.checkBlock)
+	if err != nil {
+		// Truncated or overwritten, the following blocks can't be found.
+		return err
+	}
+
+	for _, root := range header.Roots {
+		if root.Prefix().MhType == mh.IDENTITY {
+			continue
+		}
+		if _, ok := v.blocks[string(root.Hash())]; !ok {
+			v.problem(&v.missing, "missing root %s", root)
+		}
+		err = v.walk(root)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, b := range v.order {
+		first := v.blocks[string(b.Cid.Hash())]
+		switch {
+		case first.linked:
+		case isPadBlock(b.carBlock):
+			v.checkPadBlock(b)
+		case first == b:
+			v.problem(&v.orphaned, "orphaned block %s at %d", b.Cid, b.Start)
+		}
+	}
+
+	if layout.IndexOffset != 0 {
+		index := make([]byte, st.Size()-layout.IndexOffset)
+		_, err = f.ReadAt(index, layout.IndexOffset)
+		if err != nil {
+			return fmt.Errorf("reading index: %w", err)
+		}
+		v.checkIndex(index)
+	}
+	return nil
+}
+
+func (v *carVerifier) read(b carBlock) ([]byte, error) {
+	if int64(cap(v.buf)) < b.Length {
+		v.buf = make([]byte, b.Length)
+	}
+	data := v.buf[:b.Length]
+	_, err := v.data.ReadAt(data, b.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("reading block %s at %d: %w", b.Cid, b.Start, err)
+	}
+	return data, nil
+}
+
+// checkBlock rehashes b against its CID.
+func (v *carVerifier) checkBlock(b carBlock) error {
+	v.blocksN++
+	k := string(b.Cid.Hash())
+	vb := &verifyBlock{carBlock: b}
+	v.starts[b.Start] = k
+	if _, ok := v.blocks[k]; !ok {
+		// Duplicates still need to be correct but only the first copy is walked.
+		v.blocks[k] = vb
+	}
+	v.order = append(v.order, vb)
+
+	data, err := v.read(b)
+	if err != nil {
+		return err
+	}
+	d, err := mh.Decode(b.Cid.Hash())
+	if err != nil {
+		v.problem(&v.corrupt, "block %s at %d has an invalid multihash: %s", b.Cid, b.Start, err)
+		vb.corrupt = true
+		return nil
+	}
+	sum, err := mh.Sum(data, d.Code, d.Length)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning %s: can't check block %s at %d: %s\n", v.path, b.Cid, b.Start, err)
+		return nil
+	}
+	if !bytes.Equal(sum, b.Cid.Hash()) {
+		v.problem(&v.corrupt, "block %s at %d doesn't match its hash", b.Cid, b.Start)
+		vb.corrupt = true
+	}
+	return nil
+}
+
+// checkPadBlock checks b is encoded like createPadBlockHeader does, the hash
+// already checked the body is zeros.
+func (v *carVerifier) checkPadBlock(b *verifyBlock) {
+	if b.corrupt {
+		return
+	}
+	size := b.Offset + b.Length - b.Start
+	if size < fakeBlockMinLength || size-fakeBlockOverheadLength >= int64(fakeBlockMaxValue) {
+		v.problem(&v.orphaned, "orphaned block %s at %d", b.Cid, b.Start)
+		return
+	}
+	header := make([]byte, fakeBlockOverheadLength)
+	_, err := v.data.ReadAt(header, b.Start)
+	if err != nil || !bytes.Equal(header, createPadBlockHeader(uint16(size))) {
+		v.problem(&v.corrupt, "padding block at %d is badly encoded", b.Start)
+	}
+}
+
+// walk marks the blocks linked from root, dag-pb blocks are decoded by the
+// CID they are linked with since this tool stores them under raw CIDs.
+func (v *carVerifier) walk(root cid.Cid) error {
+	type link struct {
+		c      cid.Cid
+		parent cid.Cid
+	}
+	stack := []link{{c: root}}
+	for len(stack) != 0 {
+		l := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if l.c.Prefix().MhType == mh.IDENTITY {
+			continue
+		}
+		b, ok := v.blocks[string(l.c.Hash())]
+		if !ok {
+			switch {
+			case !l.parent.Defined():
+				// Missing roots are already reported.
+			case v.missingOk:
+				v.missing++
+			default:
+				v.problem(&v.missing, "missing block %s linked by %s", l.c, l.parent)
+			}
+			continue
+		}
+		if b.linked {
+			continue
+		}
+		b.linked = true
+		if b.corrupt || l.c.Type() != cid.DagProtobuf {
+			continue
+		}
+
+		data, err := v.read(b.carBlock)
+		if err != nil {
+			return err
+		}
+		var n pb.PBNode
+		err = proto.Unmarshal(data, &n)
+		if err != nil {
+			v.problem(&v.corrupt, "block %s at %d isn't dag-pb: %s", l.c, b.Start, err)
+			continue
+		}
+		for i := len(n.Links) - 1; i >= 0; i-- {
+			c, err := cid.Cast(n.Links[i].Hash)
+			if err != nil {
+				v.problem(&v.corrupt, "block %s at %d has an invalid link %d: %s", l.c, b.Start, i, err)
+				continue
+			}
+			stack = append(stack, link{c, l.c})
+		}
+	}
+	return nil
+}
+
+// checkIndex checks each index entry locates a block with that hash and
+// every block but the padding is indexed.
+func (v *carVerifier) checkIndex(b []byte) {
+	entries, err := unmarshalMultihashIndexSorted(b)
+	if errors.Is(err, errUnsupportedIndex) {
+		fmt.Fprintf(os.Stderr, "warning %s: not checking the index: %s\n", v.path, err)
+		return
+	}
+	if err != nil {
+		v.problem(&v.corrupt, "invalid index: %s", err)
+		return
+	}
+	for k, off := range entries {
+		if v.starts[off] != k {
+			c := cid.NewCidV1(cid.Raw, mh.Multihash(k))
+			v.problem(&v.corrupt, "index entry for %s points to %d which isn't that block", c, off)
+		}
+	}
+	for k, b := range v.blocks {
+		if _, ok := entries[k]; !ok && !isPadBlock(b.carBlock) {
+			v.problem(&v.corrupt, "block %s at %d isn't indexed", b.Cid, b.Start)
+		}
+	}
+}
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"strconv"
 )
 
 const (
@@ -22,7 +19,7 @@ var web3StorageDriverCreator = driverCreator{
 
 func web3StorageHelp(out io.Writer) {
 	fmt.Fprint(out, `  Environ:
-  - `+envWeb3StorageKeyKey+` web3.storage API key
+  - `+envWeb3StorageKeyKey+` web3.storage API key (secret)
 
 `)
 }
@@ -32,49 +29,24 @@ func newWeb3StorageDriver(input string) (driver, error) {
 		return nil, fmt.Errorf("non empty web3.storage argument: %q", input)
 	}
 
-	key := os.Getenv(envWeb3StorageKeyKey)
-
-	if key == "" {
-		return nil, fmt.Errorf("error empty " + envWeb3StorageKeyKey + " envKey")
-	}
-
-	d := &web3StorageDriver{
-		key: key,
-	}
-	return d.send, nil
-}
-
-type web3StorageDriver struct {
-	key string
-
-	client http.Client
-}
-
-func (e *web3StorageDriver) send(headerBuffer []byte, car *os.File, carOffset int64) error {
-	_, err := car.Seek(carOffset, io.SeekStart)
+	key, err := getSecret(envWeb3StorageKeyKey)
 	if err != nil {
-		return fmt.Errorf("error seeking temp file: %w", err)
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", web3StorageEndpoint+"/car", io.MultiReader(bytes.NewReader(headerBuffer), car))
-	if err != nil {
-		return fmt.Errorf("creating the request failed: %w", err)
-	}
-
-	req.Header.Set("User-Agent", userAgent)
-	req.Header.Set("Content-Type", "application/vnd.ipld.car")
-	req.Header.Set("Authorization", "Bearer "+e.key)
-	req.Header.Set("Content-Length", strconv.FormatUint(uint64(int64(len(headerBuffer))+carMaxSize-carOffset), 10))
-
-	resp, err := e.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("posting failed: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("non 200 result code: %d / body: %s", resp.StatusCode, string(b))
+	if key == "" {
+		return nil, fmt.Errorf("error empty " + envWeb3StorageKeyKey + " envKey")
 	}
 
-	return nil
+	return &httpDriver{
+		urlTemplate: web3StorageEndpoint + "/car",
+		method:      "POST",
+		header: http.Header{
+			"Content-Type":  {"application/vnd.ipld.car"},
+			"Authorization": {"Bearer " + key},
+		},
+		expected: []int{200},
+		cidPath:  jsonPath{"cid"},
+		client:   newHTTPClient(),
+	}, nil
 }